@@ -11,4 +11,12 @@ const (
 	InvalidTid TransactionId = 0
 
 	InvalidCsn CommitSequenceNumber = 0
+
+	// FrozenCsn is the csn of transactions whose commit log has been truncated,
+	// they committed before any snapshot that may still read their entries.
+	// It is never assigned to a commit, the first commit gets FrozenCsn + 1
+	FrozenCsn CommitSequenceNumber = 1
+
+	// AbortedCsn marks a transaction that has been rolled back
+	AbortedCsn CommitSequenceNumber = ^CommitSequenceNumber(0)
 )
@@ -1,5 +1,27 @@
 package base
 
 type (
+	// UndoRecordPtr is the position of an undo record
+	// segment(32) | page(16) | offset(16)
 	UndoRecordPtr uint64
 )
+
+const (
+	InvalidUndoRecordPtr UndoRecordPtr = 0
+)
+
+func MakeUndoRecordPtr(segment uint32, page uint16, offset OffsetNumber) UndoRecordPtr {
+	return UndoRecordPtr(uint64(segment)<<32 | uint64(page)<<16 | uint64(offset))
+}
+
+func (ptr UndoRecordPtr) Segment() uint32 {
+	return uint32(ptr >> 32)
+}
+
+func (ptr UndoRecordPtr) Page() uint16 {
+	return uint16(ptr >> 16)
+}
+
+func (ptr UndoRecordPtr) Offset() OffsetNumber {
+	return OffsetNumber(ptr)
+}
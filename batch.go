@@ -0,0 +1,126 @@
+package ingens
+
+import (
+	"bytes"
+	"sort"
+)
+
+// WriteBatch collects Put and Delete operations and applies them in key order
+// with Txn.Write. Consecutive keys that fall into the same leaf share one
+// descent and one leaf write lock.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put add an operation that sets key to hold the value
+// key and value are copied, they can be reused after Put returns
+func (wb *WriteBatch) Put(key, value []byte) {
+	wb.ops = append(wb.ops, batchOp{key: clone(key), value: clone(value)})
+}
+
+// Delete add an operation that deletes key, deleting a missing key does nothing
+func (wb *WriteBatch) Delete(key []byte) {
+	wb.ops = append(wb.ops, batchOp{key: clone(key), delete: true})
+}
+
+// Len return the number of operations in the batch
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+// Reset remove all operations from the batch
+func (wb *WriteBatch) Reset() {
+	wb.ops = wb.ops[:0]
+}
+
+// clone 复制 b，nil 仍然为 nil，由 Txn.Write 检查
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// sorted 返回按 key 排序的操作，同一个 key 只保留最后一次操作
+func (wb *WriteBatch) sorted() []batchOp {
+	ops := make([]batchOp, len(wb.ops))
+	copy(ops, wb.ops)
+	sort.SliceStable(ops, func(i, j int) bool {
+		return bytes.Compare(ops[i].key, ops[j].key) < 0
+	})
+
+	n := 0
+	for i := range ops {
+		if i+1 < len(ops) && bytes.Equal(ops[i].key, ops[i+1].key) {
+			continue
+		}
+		ops[n] = ops[i]
+		n++
+	}
+	return ops[:n]
+}
+
+// Write apply all operations of the batch in the transaction
+func (txn *Txn) Write(wb *WriteBatch) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return err
+	}
+
+	// check if the keys and values are valid
+	for _, op := range wb.ops {
+		if err := txn.ing.opt.CheckKey(op.key); err != nil {
+			return err
+		}
+		if op.delete {
+			continue
+		}
+		if err := txn.ing.opt.CheckValue(op.value); err != nil {
+			return err
+		}
+	}
+
+	if len(wb.ops) == 0 {
+		return nil
+	}
+
+	// keys, values
+	ops := wb.sorted()
+	if txn.ing.opt.Copy {
+		for i := range ops {
+			key := ops[i].key
+			ops[i].key = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+			copy(ops[i].key, key)
+			defer txn.ing.mmgr.Free(ops[i].key)
+
+			if ops[i].delete {
+				continue
+			}
+			value := ops[i].value
+			ops[i].value = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
+			copy(ops[i].value, value)
+			defer txn.ing.mmgr.Free(ops[i].value)
+		}
+	}
+
+	// write batch
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.writeBatch(txn, ops)
+}
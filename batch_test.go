@@ -0,0 +1,138 @@
+package ingens
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	test := []struct {
+		name string
+
+		copy  bool
+		build func(wb *WriteBatch)
+		want  map[string]string // 写入后 key 的值，"" 表示不存在
+		err   error
+	}{
+		{"put", false, func(wb *WriteBatch) {
+			wb.Put([]byte("b"), []byte("2"))
+			wb.Put([]byte("a"), []byte("1"))
+		}, map[string]string{"a": "1", "b": "2"}, nil},
+		{"last wins", false, func(wb *WriteBatch) {
+			wb.Put([]byte("a"), []byte("1"))
+			wb.Delete([]byte("a"))
+			wb.Put([]byte("b"), []byte("1"))
+			wb.Put([]byte("b"), []byte("2"))
+		}, map[string]string{"a": "", "b": "2"}, nil},
+		{"delete existing and missing", false, func(wb *WriteBatch) {
+			wb.Delete([]byte("old"))
+			wb.Delete([]byte("missing"))
+		}, map[string]string{"old": "", "missing": ""}, nil},
+		{"reuse buffers", false, func(wb *WriteBatch) {
+			key, value := []byte("a"), []byte("1")
+			wb.Put(key, value)
+			key[0], value[0] = 'b', '2'
+			wb.Put(key, value)
+		}, map[string]string{"a": "1", "b": "2"}, nil},
+		{"copy", true, func(wb *WriteBatch) {
+			wb.Put([]byte("a"), []byte("1"))
+			wb.Delete([]byte("old"))
+		}, map[string]string{"a": "1", "old": ""}, nil},
+		{"nil key", false, func(wb *WriteBatch) {
+			wb.Put([]byte("a"), []byte("1"))
+			wb.Put(nil, []byte("1"))
+		}, map[string]string{"a": ""}, ErrKeyEmpty},
+		{"nil delete key", true, func(wb *WriteBatch) {
+			wb.Delete(nil)
+		}, nil, ErrKeyEmpty},
+		{"nil value", true, func(wb *WriteBatch) {
+			wb.Put([]byte("a"), nil)
+		}, map[string]string{"a": ""}, ErrValueEmpty},
+		{"empty value", false, func(wb *WriteBatch) {
+			wb.Put([]byte("a"), []byte{})
+		}, nil, nil},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := DefaultOptions()
+			opt.Copy = tt.copy
+			ing := openTest(t, opt)
+			defer ing.Close(true)
+
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("old"), []byte("0")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			wb := NewWriteBatch()
+			tt.build(wb)
+			err := ing.Exec(func(txn *Txn) error { return txn.Write(wb) })
+			if err != tt.err {
+				t.Fatalf("Write() err: got = %v, want = %v", err, tt.err)
+			}
+
+			err = ing.View(func(txn *Txn) error {
+				for key, want := range tt.want {
+					got, err := txn.Get([]byte(key))
+					if want == "" && err != ErrNotFoundEntry {
+						return fmt.Errorf("Get(%s): got = %s, %v, want = %v", key, got, err, ErrNotFoundEntry)
+					}
+					if want != "" && (err != nil || string(got) != want) {
+						return fmt.Errorf("Get(%s): got = %s, %v, want = %s", key, got, err, want)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWriteBatchSplit(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	// 覆盖写入偶数 key，插入奇数 key，删除 4 的倍数，批量操作跨越多个叶子节点并拆分它们
+	wb := NewWriteBatch()
+	for i := n - 1; i >= 0; i-- {
+		if i%4 == 0 {
+			wb.Delete(iterKey(i))
+		} else {
+			wb.Put(iterKey(i), []byte(fmt.Sprint("batch", i)))
+		}
+	}
+	if wb.Len() != n {
+		t.Fatalf("Len(): got = %v, want = %v", wb.Len(), n)
+	}
+	if err := ing.Exec(func(txn *Txn) error { return txn.Write(wb) }); err != nil {
+		t.Fatalf("Write() err: %v", err)
+	}
+	wb.Reset()
+	if wb.Len() != 0 {
+		t.Errorf("Reset() Len(): got = %v, want = 0", wb.Len())
+	}
+
+	err := ing.View(func(txn *Txn) error {
+		i := 1
+		for it := txn.ScanPrefix(nil); it.Valid(); it.Next() {
+			if i%4 == 0 {
+				i++
+			}
+			if !bytes.Equal(it.Key(), iterKey(i)) || string(it.Value()) != fmt.Sprint("batch", i) {
+				return fmt.Errorf("Key(): got = %.8s %s, want = %.8s", it.Key(), it.Value(), iterKey(i))
+			}
+			i++
+		}
+		if i != n {
+			return fmt.Errorf("last key: got = %v, want = %v", i-1, n-1)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
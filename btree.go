@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"container/list"
 	"errors"
-	"fmt"
 	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/locker"
 	"github/suixinpr/ingens/nodes"
+	"github/suixinpr/ingens/undo"
+	"math"
+	"sort"
 	"sync/atomic"
 )
 
@@ -22,11 +25,31 @@ var (
 
 	// ErrDeadEntry
 	ErrDeadEntry = errors.New("entry is dead")
+
+	// ErrWriteConflict the newest version of the entry is not visible to the snapshot of the transaction
+	ErrWriteConflict = errors.New("write conflict with a concurrent transaction")
+
+	// ErrSerializationFailure the transaction could make the result non-serializable
+	ErrSerializationFailure = errors.New("could not serialize access due to read/write dependencies among transactions")
+
+	// ErrValueNotInteger the value is not an 8-byte big-endian int64
+	ErrValueNotInteger = errors.New("value is not an integer")
+
+	// ErrIntegerOverflow increment or decrement would overflow int64
+	ErrIntegerOverflow = errors.New("increment or decrement would overflow")
+
+	// errTooManyLevels the height of the btree exceeds levelSize
+	errTooManyLevels = errors.New("too many btree levels")
+
+	// errCompareFailed the current value does not equal the expected value
+	errCompareFailed = errors.New("current value does not equal the expected value")
 )
 
 // 操作
 
-func (ing *Ingens) get(snapshot base.TransactionId, key []byte) ([]byte, error) {
+func (ing *Ingens) get(txn *Txn, key []byte) ([]byte, error) {
+	ing.recordRead(txn, key)
+
 	// search node
 	node, _, err := ing.search(key)
 	if err != nil {
@@ -48,17 +71,13 @@ func (ing *Ingens) get(snapshot base.TransactionId, key []byte) ([]byte, error)
 	}
 
 	// Search data entry in version chain
-	de := node.GetDataEntry(off)
-	if snapshot < de.Tid() {
-		if de = ing.umgr.SearchInVersionChain(de, snapshot); de == nil {
-			node.RUnlock()
-			node.Release()
-			return nil, ErrNotFoundEntry
-		}
+	de, err := ing.visibleDataEntry(txn, node.GetDataEntry(off))
+	if err != nil {
+		node.RUnlock()
+		node.Release()
+		return nil, err
 	}
-
-	// dead
-	if de.IsDead() {
+	if de == nil || de.IsDead() {
 		node.RUnlock()
 		node.Release()
 		return nil, ErrNotFoundEntry
@@ -74,13 +93,85 @@ func (ing *Ingens) get(snapshot base.TransactionId, key []byte) ([]byte, error)
 	return value, nil
 }
 
-func (ing *Ingens) setnx(tid base.TransactionId, key, value []byte) error {
+// multiGet 按 key 排序后只下降一次，通过右链接依次查找每个 key
+// 同一叶子节点中的 key 都在该节点内二分查找
+func (ing *Ingens) multiGet(txn *Txn, keys [][]byte, values [][]byte, errs []error) {
+	order := make([]int, 0, len(keys))
+	for i := range keys {
+		if errs[i] == nil {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	var node *nodes.Node
+	var err error
+	for _, i := range order {
+		if err := txn.ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		key := keys[i]
+		ing.recordRead(txn, key)
+
+		// 下降
+		if node == nil {
+			node, _, err = ing.search(key)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		// 右移，key 仍然在当前节点时不会移动
+		node, err = ing.moveRightForDown(node, key, false)
+		if err != nil {
+			node = nil
+			errs[i] = err
+			continue
+		}
+
+		// search
+		off, found := node.BinarySearch(key)
+		if !found {
+			errs[i] = ErrNotFoundEntry
+			continue
+		}
+
+		// Search data entry in version chain
+		de, err := ing.visibleDataEntry(txn, node.GetDataEntry(off))
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if de == nil || de.IsDead() {
+			errs[i] = ErrNotFoundEntry
+			continue
+		}
+
+		// value
+		values[i] = make([]byte, de.ValueSize())
+		copy(values[i], de.Value())
+	}
+
+	if node != nil {
+		node.RUnlock()
+		node.Release()
+	}
+}
+
+func (ing *Ingens) setnx(txn *Txn, key, value []byte) error {
+	tid := txn.tid
+
 	// lock entry
-	if ok := ing.lmgr.Lock(key); ok {
-		return ErrLockEntryTimeout
-	} else {
-		defer ing.lmgr.Unlock(key)
+	if err := ing.lockEntry(txn, key); err != nil {
+		return err
 	}
+	defer ing.lmgr.Unlock(key)
+	ing.recordWrite(txn, key)
 
 	// search node
 	node, stack, err := ing.search(key)
@@ -104,13 +195,31 @@ func (ing *Ingens) setnx(tid base.TransactionId, key, value []byte) error {
 		// date entry
 		de := nodes.NewDataEntry(ing.mmgr, tid, key, value)
 		defer ing.mmgr.Free(de)
+
+		// 生成回滚记录
+		if _, err := ing.newUndoRecord(node, tid, undo.UNDO_INSERT, key); err != nil {
+			return err
+		}
 		return ing.insertDataEntry(node, off, de, stack)
 	} else {
 		old := node.GetDataEntry(off)
+		if err := ing.checkWriteConflict(txn, old); err != nil {
+			node.Unlock()
+			node.Release()
+			return err
+		}
+
 		if old.IsDead() {
 			// date entry
 			de := nodes.NewDataEntry(ing.mmgr, tid, key, value)
 			defer ing.mmgr.Free(de)
+
+			// 生成回滚记录
+			undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_UPDATE, old[:old.Size()])
+			if err != nil {
+				return err
+			}
+			de.UpdateUndoRecordPtr(undoRecPtr)
 			return ing.updateDataEntry(node, off, de, stack)
 		} else {
 			node.Unlock()
@@ -120,13 +229,15 @@ func (ing *Ingens) setnx(tid base.TransactionId, key, value []byte) error {
 	}
 }
 
-func (ing *Ingens) update(tid base.TransactionId, key, value []byte) error {
+func (ing *Ingens) update(txn *Txn, key, value []byte) error {
+	tid := txn.tid
+
 	// lock entry
-	if ok := ing.lmgr.Lock(key); ok {
-		return ErrLockEntryTimeout
-	} else {
-		defer ing.lmgr.Unlock(key)
+	if err := ing.lockEntry(txn, key); err != nil {
+		return err
 	}
+	defer ing.lmgr.Unlock(key)
+	ing.recordWrite(txn, key)
 
 	// search node
 	node, stack, err := ing.search(key)
@@ -153,24 +264,41 @@ func (ing *Ingens) update(tid base.TransactionId, key, value []byte) error {
 	}
 
 	old := node.GetDataEntry(off)
+	if err := ing.checkWriteConflict(txn, old); err != nil {
+		node.Unlock()
+		node.Release()
+		return err
+	}
+
+	// 已删除的 entry 视为不存在
 	if old.IsDead() {
-		return ErrDeadEntry
+		node.Unlock()
+		node.Release()
+		return ErrNotFoundEntry
 	}
 
 	// date entry
 	de := nodes.NewDataEntry(ing.mmgr, tid, key, value)
 	defer ing.mmgr.Free(de)
 
+	// 生成回滚记录
+	undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_UPDATE, old[:old.Size()])
+	if err != nil {
+		return err
+	}
+	de.UpdateUndoRecordPtr(undoRecPtr)
 	return ing.updateDataEntry(node, off, de, stack)
 }
 
-func (ing *Ingens) set(tid base.TransactionId, key, value []byte) error {
+func (ing *Ingens) set(txn *Txn, key, value []byte) error {
+	tid := txn.tid
+
 	// lock entry
-	if ok := ing.lmgr.Lock(key); ok {
-		return ErrLockEntryTimeout
-	} else {
-		defer ing.lmgr.Unlock(key)
+	if err := ing.lockEntry(txn, key); err != nil {
+		return err
 	}
+	defer ing.lmgr.Unlock(key)
+	ing.recordWrite(txn, key)
 
 	// search node
 	node, stack, err := ing.search(key)
@@ -195,19 +323,172 @@ func (ing *Ingens) set(tid base.TransactionId, key, value []byte) error {
 	// search
 	off, found := node.BinarySearch(key)
 	if found {
+		old := node.GetDataEntry(off)
+		if err := ing.checkWriteConflict(txn, old); err != nil {
+			node.Unlock()
+			node.Release()
+			return err
+		}
+
+		// 生成回滚记录
+		undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_UPDATE, old[:old.Size()])
+		if err != nil {
+			return err
+		}
+		de.UpdateUndoRecordPtr(undoRecPtr)
 		return ing.updateDataEntry(node, off, de, stack)
 	} else {
+		// 生成回滚记录
+		if _, err := ing.newUndoRecord(node, tid, undo.UNDO_INSERT, key); err != nil {
+			return err
+		}
 		return ing.insertDataEntry(node, off, de, stack)
 	}
 }
 
-func (ing *Ingens) delete(tid base.TransactionId, key []byte) error {
+// modify 在同一次下降中读取并改写 key 对应的 entry，读取和写入都在叶子节点写锁内完成
+// fn 接收当前值，key 不存在或已删除时为 nil，返回的值将写入 entry
+// fn 接收的当前值指向页面，不能在 fn 返回后继续使用
+func (ing *Ingens) modify(txn *Txn, key []byte, fn func(old []byte) ([]byte, error)) error {
+	tid := txn.tid
+
 	// lock entry
-	if ok := ing.lmgr.Lock(key); ok {
-		return ErrLockEntryTimeout
+	if err := ing.lockEntry(txn, key); err != nil {
+		return err
+	}
+	defer ing.lmgr.Unlock(key)
+	ing.recordWrite(txn, key)
+
+	// search node
+	node, stack, err := ing.search(key)
+	if err != nil {
+		return err
+	}
+
+	// 释放读锁，获取写锁
+	node.RUnlock()
+	node.Lock()
+
+	// 右移
+	node, err = ing.moveRightForDown(node, key, true)
+	if err != nil {
+		return err
+	}
+
+	// search
+	off, found := node.BinarySearch(key)
+	var old nodes.DataEntry
+	var value []byte
+	if found {
+		old = node.GetDataEntry(off)
+		if err := ing.checkWriteConflict(txn, old); err != nil {
+			node.Unlock()
+			node.Release()
+			return err
+		}
+
+		if !old.IsDead() {
+			value = old.Value()
+		}
+	}
+
+	// 计算新值
+	value, err = fn(value)
+	if err != nil {
+		node.Unlock()
+		node.Release()
+		return err
+	}
+
+	// date entry
+	de := nodes.NewDataEntry(ing.mmgr, tid, key, value)
+	defer ing.mmgr.Free(de)
+
+	if found {
+		// 生成回滚记录
+		undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_UPDATE, old[:old.Size()])
+		if err != nil {
+			return err
+		}
+		de.UpdateUndoRecordPtr(undoRecPtr)
+		return ing.updateDataEntry(node, off, de, stack)
 	} else {
-		defer ing.lmgr.Unlock(key)
+		// 生成回滚记录
+		if _, err := ing.newUndoRecord(node, tid, undo.UNDO_INSERT, key); err != nil {
+			return err
+		}
+		return ing.insertDataEntry(node, off, de, stack)
 	}
+}
+
+// getset 写入 value 并返回旧值，key 不存在或已删除时旧值为 nil
+func (ing *Ingens) getset(txn *Txn, key, value []byte) ([]byte, error) {
+	var prev []byte
+	err := ing.modify(txn, key, func(old []byte) ([]byte, error) {
+		if old != nil {
+			prev = make([]byte, len(old))
+			copy(prev, old)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+// compareAndSwap 当前值等于 expected 时写入 value
+// expected 为 nil 表示 key 不存在
+func (ing *Ingens) compareAndSwap(txn *Txn, key, expected, value []byte) (bool, error) {
+	err := ing.modify(txn, key, func(old []byte) ([]byte, error) {
+		if (old == nil) != (expected == nil) || !bytes.Equal(old, expected) {
+			return nil, errCompareFailed
+		}
+		return value, nil
+	})
+
+	switch err {
+	case nil:
+		return true, nil
+	case errCompareFailed:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// incrBy 将 key 对应的整数加上 delta，key 不存在时视为 0
+func (ing *Ingens) incrBy(txn *Txn, key []byte, delta int64) (int64, error) {
+	var n int64
+	err := ing.modify(txn, key, func(old []byte) ([]byte, error) {
+		if old != nil {
+			var err error
+			if n, err = DecodeInt64(old); err != nil {
+				return nil, err
+			}
+		}
+
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, ErrIntegerOverflow
+		}
+		n += delta
+		return EncodeInt64(n), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (ing *Ingens) delete(txn *Txn, key []byte) error {
+	tid := txn.tid
+
+	// lock entry
+	if err := ing.lockEntry(txn, key); err != nil {
+		return err
+	}
+	defer ing.lmgr.Unlock(key)
+	ing.recordWrite(txn, key)
 
 	node, _, err := ing.search(key)
 	if err != nil {
@@ -234,6 +515,12 @@ func (ing *Ingens) delete(tid base.TransactionId, key []byte) error {
 
 	// 获取entry
 	entry := node.GetDataEntry(off)
+	if err := ing.checkWriteConflict(txn, entry); err != nil {
+		node.Unlock()
+		node.Release()
+		return err
+	}
+
 	if entry.IsDead() {
 		node.Unlock()
 		node.Release()
@@ -241,12 +528,17 @@ func (ing *Ingens) delete(tid base.TransactionId, key []byte) error {
 	}
 
 	// 生成回滚记录
-	undoRecPtr := ing.umgr.NewUndoRecordPtr(tid, entry)
+	undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_DELETE, entry[:entry.Size()])
+	if err != nil {
+		return err
+	}
 
 	// update entry
 	entry.UpdateUndoRecordPtr(undoRecPtr)
 	entry.UpdateTid(tid)
 	entry.MarkDead()
+	node.MarkDirty()
+	atomic.AddUint64(&ing.deadEntries, 1)
 
 	// finish
 	node.Unlock()
@@ -254,6 +546,363 @@ func (ing *Ingens) delete(tid base.TransactionId, key []byte) error {
 	return nil
 }
 
+// deleteRange 删除 [start, end) 范围内的 entry，end 为 nil 表示没有上界
+// 沿叶子节点的右链接只遍历一次，节点写锁保证修改的原子性，不再为每个 key 加锁
+func (ing *Ingens) deleteRange(txn *Txn, start, end []byte) error {
+	tid := txn.tid
+
+	// 可串行化事务记录删除的范围，并发事务在范围内插入的 key 同样构成读写反依赖
+	if txn.sxact != nil {
+		ing.rmgr.ReadRange(txn.sxact, start, end)
+	}
+
+	node, _, err := ing.search(start)
+	if err != nil {
+		return err
+	}
+
+	// 释放读锁，获取写锁
+	node.RUnlock()
+	node.Lock()
+
+	// 右移
+	node, err = ing.moveRightForDown(node, start, true)
+	if err != nil {
+		return err
+	}
+
+	off, _ := node.BinarySearch(start)
+	for {
+		for ; off < node.GetEndOff(); off += nodes.EntryPtrSize {
+			entry := node.GetDataEntry(off)
+			if end != nil && bytes.Compare(entry.Key(), end) >= 0 {
+				node.Unlock()
+				node.Release()
+				return nil
+			}
+
+			// 先检查冲突，并发事务写入的删除标记同样是冲突
+			if err := ing.checkWriteConflict(txn, entry); err != nil {
+				node.Unlock()
+				node.Release()
+				return err
+			}
+
+			// 已提交且可见的删除标记无需再次删除
+			if entry.IsDead() {
+				continue
+			}
+			ing.recordWrite(txn, entry.Key())
+
+			// 生成回滚记录
+			undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_DELETE, entry[:entry.Size()])
+			if err != nil {
+				return err
+			}
+
+			// update entry
+			entry.UpdateUndoRecordPtr(undoRecPtr)
+			entry.UpdateTid(tid)
+			entry.MarkDead()
+			node.MarkDirty()
+			atomic.AddUint64(&ing.deadEntries, 1)
+		}
+
+		if node.IsRightmost() {
+			node.Unlock()
+			node.Release()
+			return nil
+		}
+
+		// 请求取消时停止遍历，已删除的 entry 随事务回滚恢复
+		if err := txn.ctx.Err(); err != nil {
+			node.Unlock()
+			node.Release()
+			return err
+		}
+
+		// 右移
+		node, err = ing.moveRight(node, true)
+		if err != nil {
+			return err
+		}
+		off = node.GetBeginOff()
+	}
+}
+
+// writeBatch 按 key 的顺序写入 ops，ops 已经排序且 key 不重复
+// 落在同一叶子节点的连续 key 共享一次下降和节点写锁
+// 需要拆分节点时交给 insertDataEntry/updateDataEntry 处理，之后的 key 重新下降
+func (ing *Ingens) writeBatch(txn *Txn, ops []batchOp) error {
+	tid := txn.tid
+
+	var node *nodes.Node
+	var stack *list.List
+	var err error
+
+	for _, op := range ops {
+		// 请求取消时停止写入，已写入的 key 随事务回滚恢复
+		if err := txn.ctx.Err(); err != nil {
+			if node != nil {
+				node.Unlock()
+				node.Release()
+			}
+			return err
+		}
+		ing.recordWrite(txn, op.key)
+
+		// 下降
+		if node == nil {
+			node, stack, err = ing.search(op.key)
+			if err != nil {
+				return err
+			}
+
+			// 释放读锁，获取写锁
+			node.RUnlock()
+			node.Lock()
+		}
+
+		// 右移，key 仍然在当前节点时不会移动
+		node, err = ing.moveRightForDown(node, op.key, true)
+		if err != nil {
+			return err
+		}
+
+		// search
+		off, found := node.BinarySearch(op.key)
+		var old nodes.DataEntry
+		if found {
+			old = node.GetDataEntry(off)
+			if err := ing.checkWriteConflict(txn, old); err != nil {
+				node.Unlock()
+				node.Release()
+				return err
+			}
+		}
+
+		// delete
+		if op.delete {
+			if found && !old.IsDead() {
+				// 生成回滚记录
+				undoRecPtr, err := ing.newUndoRecord(node, tid, undo.UNDO_DELETE, old[:old.Size()])
+				if err != nil {
+					return err
+				}
+
+				// update entry
+				old.UpdateUndoRecordPtr(undoRecPtr)
+				old.UpdateTid(tid)
+				old.MarkDead()
+				node.MarkDirty()
+				atomic.AddUint64(&ing.deadEntries, 1)
+			}
+			continue
+		}
+
+		// 生成回滚记录
+		var undoRecPtr base.UndoRecordPtr
+		if found {
+			undoRecPtr, err = ing.newUndoRecord(node, tid, undo.UNDO_UPDATE, old[:old.Size()])
+		} else {
+			_, err = ing.newUndoRecord(node, tid, undo.UNDO_INSERT, op.key)
+		}
+		if err != nil {
+			return err
+		}
+
+		// date entry
+		de := nodes.NewDataEntry(ing.mmgr, tid, op.key, op.value)
+		if found {
+			de.UpdateUndoRecordPtr(undoRecPtr)
+		}
+
+		// 节点未满，直接写入，继续持有节点
+		if found && ing.updateDataEntryInPlace(node, off, de) ||
+			!found && ing.insertDataEntryInPlace(node, off, de) {
+			ing.mmgr.Free(de)
+			continue
+		}
+
+		// 节点已满，拆分后节点已经释放
+		if found {
+			err = ing.updateDataEntry(node, off, de, stack)
+		} else {
+			err = ing.insertDataEntry(node, off, de, stack)
+		}
+		ing.mmgr.Free(de)
+		node = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if node != nil {
+		node.Unlock()
+		node.Release()
+	}
+	return nil
+}
+
+// newUndoRecord 为事务追加回滚记录，失败时释放持有写锁的 node
+// undo 空间超出上限并且 Option.UndoPolicy 为 UndoRejectWrites 时拒绝写入，回滚不受影响
+func (ing *Ingens) newUndoRecord(node *nodes.Node, tid base.TransactionId, opr uint8, data []byte) (base.UndoRecordPtr, error) {
+	if atomic.LoadUint32(&ing.undoExhausted) == 1 {
+		node.Unlock()
+		node.Release()
+		return base.InvalidUndoRecordPtr, ErrUndoSpaceExhausted
+	}
+
+	ptr, err := ing.umgr.NewUndoRecordPtr(tid, opr, data)
+	if err != nil {
+		node.Unlock()
+		node.Release()
+		return base.InvalidUndoRecordPtr, err
+	}
+	return ptr, nil
+}
+
+// checkWriteConflict 快照隔离下先提交者获胜
+// key 的最新版本由未提交的事务写入，或者由快照之后提交的事务写入时，写入会覆盖快照看不到的修改，
+// 返回 ErrWriteConflict，事务回滚后可以重试
+func (ing *Ingens) checkWriteConflict(txn *Txn, de nodes.DataEntry) error {
+	if ing.isVisible(txn, de.Tid()) {
+		return nil
+	}
+
+	// 读已提交只要求最新版本已经提交
+	if txn.isolation == ReadCommitted && ing.tmgr.IsCommitted(de.Tid()) {
+		return nil
+	}
+	return ErrWriteConflict
+}
+
+// isVisible 判断 tid 写入的版本对事务是否可见
+// 事务自己的修改总是可见，其余修改只有在快照之前提交才可见
+func (ing *Ingens) isVisible(txn *Txn, tid base.TransactionId) bool {
+	if tid != base.InvalidTid && tid == txn.tid {
+		return true
+	}
+	return ing.tmgr.CheckVisibility(tid, txn.snapshot)
+}
+
+// visibleDataEntry 沿版本链查找快照可见的版本，不存在可见版本时返回nil
+// 返回的版本可能已经被删除，由调用者判断
+func (ing *Ingens) visibleDataEntry(txn *Txn, de nodes.DataEntry) (nodes.DataEntry, error) {
+	if !ing.isVisible(txn, de.Tid()) {
+		// 可串行化事务读到了并发事务写入的新版本
+		if txn.sxact != nil {
+			ing.rmgr.ReadConflict(txn.sxact, de.Tid())
+		}
+		old, err := ing.umgr.SearchInVersionChain(de, func(tid base.TransactionId) bool {
+			return ing.isVisible(txn, tid)
+		})
+		// 快照需要的旧版本已经被回收
+		if errors.Is(err, undo.ErrUndoRecordNotFound) {
+			return nil, ErrSnapshotTooOld
+		}
+		return old, err
+	}
+	return de, nil
+}
+
+// lockEntry 获取 entry 锁，超时返回 ErrLockEntryTimeout，事务的 ctx 结束时返回 ctx.Err()
+func (ing *Ingens) lockEntry(txn *Txn, key []byte) error {
+	err := ing.lmgr.LockContext(txn.ctx, key, txn.timeout)
+	if errors.Is(err, locker.ErrLockTimeout) {
+		return ErrLockEntryTimeout
+	}
+	return err
+}
+
+// recordRead 可串行化事务记录读取过的 key，key 不存在时同样需要记录
+func (ing *Ingens) recordRead(txn *Txn, key []byte) {
+	if txn.sxact != nil {
+		ing.rmgr.ReadKey(txn.sxact, key)
+	}
+}
+
+// recordWrite 可串行化事务记录写入的 key，与读过该 key 的并发事务构成读写反依赖
+func (ing *Ingens) recordWrite(txn *Txn, key []byte) {
+	if txn.sxact != nil {
+		ing.rmgr.Write(txn.sxact, key)
+	}
+}
+
+// 回滚
+
+// rollback 按逆序重放事务在 until 之后的回滚记录，恢复事务修改过的 DataEntry
+// until 为 InvalidUndoRecordPtr 时回滚事务的所有修改
+func (ing *Ingens) rollback(tid base.TransactionId, until base.UndoRecordPtr) error {
+	ptr := ing.umgr.LastUndoRecordPtr(tid)
+	for ptr != until && ptr != base.InvalidUndoRecordPtr {
+		rec, err := ing.umgr.GetUndoRecord(ptr)
+		if err != nil {
+			return err
+		}
+
+		if err := ing.applyUndoRecord(tid, rec); err != nil {
+			return err
+		}
+		ptr = rec.Prev()
+	}
+
+	ing.umgr.DiscardAfter(tid, until)
+	return nil
+}
+
+// applyUndoRecord 恢复一条回滚记录
+// entry 上的 tid 为本事务，节点写锁已经足够保证恢复的原子性，不需要再加 entry 锁
+func (ing *Ingens) applyUndoRecord(tid base.TransactionId, rec undo.UndoRecord) error {
+	key := rec.Key()
+
+	// search node
+	node, stack, err := ing.search(key)
+	if err != nil {
+		return err
+	}
+
+	// 释放读锁，获取写锁
+	node.RUnlock()
+	node.Lock()
+
+	// 右移
+	node, err = ing.moveRightForDown(node, key, true)
+	if err != nil {
+		return err
+	}
+
+	// search
+	off, found := node.BinarySearch(key)
+	if !found || node.GetDataEntry(off).Tid() != tid {
+		node.Unlock()
+		node.Release()
+		return nil
+	}
+
+	switch rec.Opr() {
+	case undo.UNDO_INSERT:
+		// 插入前不存在该 entry，直接删除
+		// 非最右节点的最后一个 entry 是节点的 high key，保留为对所有事务可见的 dead entry
+		if off+nodes.EntryPtrSize == node.GetEndOff() && !node.IsRightmost() {
+			de := node.GetDataEntry(off)
+			de.UpdateTid(base.InvalidTid)
+			de.UpdateUndoRecordPtr(base.InvalidUndoRecordPtr)
+			de.MarkDead()
+			node.MarkDirty()
+			atomic.AddUint64(&ing.deadEntries, 1)
+		} else {
+			node.Delete(off)
+		}
+		node.Unlock()
+		node.Release()
+		return nil
+	default:
+		// 放回修改前的版本
+		return ing.restoreDataEntry(node, off, rec.Entry(), stack)
+	}
+}
+
 // 遍历
 
 func (ing *Ingens) search(key []byte) (*nodes.Node, *list.List, error) {
@@ -265,7 +914,7 @@ func (ing *Ingens) search(key []byte) (*nodes.Node, *list.List, error) {
 
 	// 循环，下降
 	for {
-		node, err := ing.moveRightForDown(node, key, false)
+		node, err = ing.moveRightForDown(node, key, false)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -274,10 +923,7 @@ func (ing *Ingens) search(key []byte) (*nodes.Node, *list.List, error) {
 			break
 		}
 
-		off, _ := node.BinarySearch(key)
-		if node.IsRightmost() && off >= node.GetEndOff() {
-			off -= nodes.EntryPtrSize
-		}
+		off := node.SearchChild(key)
 
 		stack.PushBack(node.GetPageId())
 
@@ -332,6 +978,33 @@ func (ing *Ingens) moveRightForDown(n *nodes.Node, key []byte, isWrite bool) (*n
 	}
 }
 
+// move right to right brother node unconditionally
+func (ing *Ingens) moveRight(n *nodes.Node, isWrite bool) (*nodes.Node, error) {
+	// 获取右节点
+	rn, err := ing.getNode(n.GetRight())
+	if err != nil {
+		if isWrite {
+			n.Unlock()
+		} else {
+			n.RUnlock()
+		}
+		n.Release()
+		return nil, err
+	}
+
+	// 释放前一节点锁，获取新节点锁
+	if isWrite {
+		n.Unlock()
+		rn.Lock()
+	} else {
+		n.RUnlock()
+		rn.RLock()
+	}
+
+	n.Release()
+	return rn, nil
+}
+
 // move right to right brother node
 func (ing *Ingens) moveRightForUp(n *nodes.Node, pageId base.PageNumber) (*nodes.Node, error) {
 	for {
@@ -382,52 +1055,77 @@ func (ing *Ingens) moveDown(n *nodes.Node, off base.OffsetNumber) (*nodes.Node,
 
 // move up to parent node
 // redirect index entry
-func (ing *Ingens) moveUp(node *nodes.Node, pageId base.PageNumber, rpageId base.PageNumber, stack *list.List, elem *list.Element) (*nodes.Node, error) {
+// 返回持有写锁的父节点，父节点中原本指向 pageId 的 IndexEntry 已经指向 rpageId
+// 同时返回该 IndexEntry 的位置，pageId 的新 IndexEntry 插入在它之前
+// 调用者持有 node 的写锁，获取父节点的写锁后才能释放
+func (ing *Ingens) moveUp(node *nodes.Node, pageId base.PageNumber, rpageId base.PageNumber, stack *list.List, elem *list.Element) (*nodes.Node, base.OffsetNumber, error) {
 	// 获取父节点，3种情况
 	// 1. 成功从栈中获取，非根节点
 	// 2. 栈为空，当前节点为根节点，此时生成新的根节点
 	// 3. 栈为空，但是此时已有其他线程创建了根节点，所以当前节点不为根节点
 	// 这个时候通过levels获取上一层的最左侧节点
 	var pnode *nodes.Node
-	if elem == nil && ing.root == node.GetPageId() {
+	var err error
+	if elem == nil && ing.getRootId() == node.GetPageId() {
 		// 不存在父节点，即当前节点为根节点，情况2
-
-		// 创建根节点，并加写锁
-		pnode, err := ing.newRoot(node.GetLevel() + 1)
+		pnode, err = ing.newRoot(node.GetLevel()+1, rpageId)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		ie := nodes.NewIndexEntry(ing.mmgr, node.GetHighKey(), rpageId)
-		defer ing.mmgr.Free(ie)
+		return pnode, pnode.GetBeginOff(), nil
+	}
 
-		pnode.Insert(pnode.GetEndOff(), ie)
+	// 已经存在父节点，情况3
+	var ppageId base.PageNumber
+	if elem == nil {
+		ing.metaMu.Lock()
+		ppageId = ing.levels[node.GetLevel()+1]
+		ing.metaMu.Unlock()
 	} else {
-		// 已经存在父节点，情况3
-		if elem == nil {
-			elem = stack.PushFront(ing.levels[node.GetLevel()+1])
-		}
-
 		// 情况1
-		ppageId := elem.Value.(base.PageNumber)
-		pnode, err := ing.getNode(ppageId)
-		if err != nil {
-			return nil, err
-		}
-		pnode.Lock()
+		ppageId = elem.Value.(base.PageNumber)
+	}
 
-		// 右移
-		pnode, err = ing.moveRightForUp(pnode, rpageId)
-		if err != nil {
-			return nil, err
-		}
+	pnode, err = ing.getNode(ppageId)
+	if err != nil {
+		return nil, 0, err
+	}
+	pnode.Lock()
 
-		// 将原本指向node的IndexEntry指向rnode
-		err = pnode.RedirectEntry(pageId, rpageId)
-		if err != nil {
-			return nil, err
-		}
+	// 右移，直到找到指向 node 的 IndexEntry
+	pnode, err = ing.moveRightForUp(pnode, pageId)
+	if err != nil {
+		return nil, 0, err
 	}
-	return pnode, nil
+
+	// 将原本指向node的IndexEntry指向rnode
+	off, err := pnode.RedirectEntry(rpageId, pageId)
+	if err != nil {
+		pnode.Unlock()
+		pnode.Release()
+		return nil, 0, err
+	}
+	return pnode, off, nil
+}
+
+// splitAndMoveUp 拆分后更新父节点，将 node 的 IndexEntry 插入父节点后释放 node
+// elem 为父节点在栈中的位置
+func (ing *Ingens) splitAndMoveUp(node *nodes.Node, rpageId base.PageNumber, stack *list.List, elem *list.Element) error {
+	pnode, off, err := ing.moveUp(node, node.GetPageId(), rpageId, stack, elem)
+	if err != nil {
+		node.Unlock()
+		node.Release()
+		return err
+	}
+
+	ie := nodes.NewIndexEntry(ing.mmgr, node.GetHighKey(), node.GetPageId())
+	defer ing.mmgr.Free(ie)
+
+	// 已经持有父节点的写锁，可以释放 node
+	node.Unlock()
+	node.Release()
+
+	return ing.insertIndexEntry(pnode, off, ie, stack, elem)
 }
 
 // data entry
@@ -435,8 +1133,7 @@ func (ing *Ingens) moveUp(node *nodes.Node, pageId base.PageNumber, rpageId base
 // insert data entry
 func (ing *Ingens) insertDataEntry(node *nodes.Node, off base.OffsetNumber, entry nodes.DataEntry, stack *list.List) error {
 	// 节点未满,直接插入
-	if entry.Size() <= node.FreeSpaceSize()-nodes.EntryPtrSize {
-		node.Insert(off, entry)
+	if ing.insertDataEntryInPlace(node, off, entry) {
 		node.Unlock()
 		node.Release()
 		return nil
@@ -445,23 +1142,18 @@ func (ing *Ingens) insertDataEntry(node *nodes.Node, off base.OffsetNumber, entr
 	// 节点已满则拆分节点
 	rpageId, err := ing.splitNode(node, off, entry.Size(), entry, nodes.SPLIT_INSERT)
 	if err != nil {
+		node.Unlock()
+		node.Release()
 		return err
 	}
 
-	elem := stack.Back()
-	pnode, err := ing.moveUp(node, node.GetPageId(), rpageId, stack, elem)
-
-	ie := nodes.NewIndexEntry(ing.mmgr, node.GetHighKey(), node.GetPageId())
-	defer ing.mmgr.Free(ie)
-
-	return ing.insertIndexEntry(pnode, ie, stack, elem)
+	return ing.splitAndMoveUp(node, rpageId, stack, stack.Back())
 }
 
 // update data entry
 func (ing *Ingens) updateDataEntry(node *nodes.Node, off base.OffsetNumber, entry nodes.DataEntry, stack *list.List) error {
 	// 节点未满,直接插入
-	if entry.Size() <= node.FreeSpaceSize()-nodes.EntryPtrSize {
-		node.Insert(off, entry)
+	if ing.updateDataEntryInPlace(node, off, entry) {
 		node.Unlock()
 		node.Release()
 		return nil
@@ -470,27 +1162,55 @@ func (ing *Ingens) updateDataEntry(node *nodes.Node, off base.OffsetNumber, entr
 	// 节点已满则拆分节点
 	rpageId, err := ing.splitNode(node, off, entry.Size(), entry, nodes.SPLIT_UPDATE)
 	if err != nil {
+		node.Unlock()
+		node.Release()
 		return err
 	}
 
-	elem := stack.Back()
-	pnode, err := ing.moveUp(node, node.GetPageId(), rpageId, stack, elem)
-
-	ie := nodes.NewIndexEntry(ing.mmgr, node.GetHighKey(), node.GetPageId())
-	defer ing.mmgr.Free(ie)
+	return ing.splitAndMoveUp(node, rpageId, stack, stack.Back())
+}
 
-	return ing.insertIndexEntry(pnode, ie, stack, elem)
+// insertDataEntryInPlace 节点空间足够时直接插入 entry 并返回 true，不释放节点
+func (ing *Ingens) insertDataEntryInPlace(node *nodes.Node, off base.OffsetNumber, entry nodes.DataEntry) bool {
+	// 空间不足时先整理页面，仍然不足时拆分
+	if entry.Size()+nodes.EntryPtrSize > node.FreeSpaceSize() {
+		node.Compact()
+		if entry.Size()+nodes.EntryPtrSize > node.FreeSpaceSize() {
+			return false
+		}
+	}
+	node.Insert(off, entry[:entry.Size()])
+	return true
 }
 
-// insert index entry
-func (ing *Ingens) insertIndexEntry(node *nodes.Node, entry nodes.IndexEntry, stack *list.List, elem *list.Element) error {
-	off, found := node.BinarySearch(entry.Key())
-	if found {
-		return nil
+// updateDataEntryInPlace 节点空间足够时用新版本替换 off 处的 entry 并返回 true，不释放节点
+func (ing *Ingens) updateDataEntryInPlace(node *nodes.Node, off base.OffsetNumber, entry nodes.DataEntry) bool {
+	// 新版本不大于原 entry 时原地写入，否则需要空闲空间
+	if entry.Size() > node.GetEntrySize(off) && entry.Size() > node.FreeSpaceSize() {
+		node.Compact()
+		if entry.Size() > node.FreeSpaceSize() {
+			return false
+		}
 	}
+	node.Replace(off, entry[:entry.Size()])
+	return true
+}
+
+// restore data entry
+func (ing *Ingens) restoreDataEntry(node *nodes.Node, off base.OffsetNumber, entry nodes.DataEntry, stack *list.List) error {
+	return ing.updateDataEntry(node, off, entry, stack)
+}
 
+// insert index entry
+// off 为拆分后右节点的 IndexEntry 的位置，左节点的 IndexEntry 总是紧挨在它之前
+// 最右节点的最后一个 key 不会随子节点增长而更新，不能通过二分查找确定插入位置
+// elem 为 node 在栈中的位置，node 不是从栈中获取时为 nil
+func (ing *Ingens) insertIndexEntry(node *nodes.Node, off base.OffsetNumber, entry nodes.IndexEntry, stack *list.List, elem *list.Element) error {
 	// 节点未满,直接插入
-	if entry.Size() <= node.FreeSpaceSize()-nodes.EntryPtrSize {
+	if entry.Size()+nodes.EntryPtrSize > node.FreeSpaceSize() {
+		node.Compact()
+	}
+	if entry.Size()+nodes.EntryPtrSize <= node.FreeSpaceSize() {
 		node.Insert(off, entry)
 		node.Unlock()
 		node.Release()
@@ -500,29 +1220,32 @@ func (ing *Ingens) insertIndexEntry(node *nodes.Node, entry nodes.IndexEntry, st
 	// 节点已满则拆分节点
 	rpageId, err := ing.splitNode(node, off, entry.Size(), entry, nodes.SPLIT_INSERT)
 	if err != nil {
+		node.Unlock()
+		node.Release()
 		return err
 	}
 
-	pnode, err := ing.moveUp(node, node.GetPageId(), rpageId, stack, elem)
-
-	ie := nodes.NewIndexEntry(ing.mmgr, node.GetHighKey(), node.GetPageId())
-	defer ing.mmgr.Free(ie)
-
-	return ing.insertIndexEntry(pnode, ie, stack, elem.Prev())
+	var pelem *list.Element
+	if elem != nil {
+		pelem = elem.Prev()
+	}
+	return ing.splitAndMoveUp(node, rpageId, stack, pelem)
 }
 
 func (ing *Ingens) splitNode(node *nodes.Node, off base.OffsetNumber, size base.OffsetNumber, entry []byte, opr uint8) (base.PageNumber, error) {
-	rnode, err := ing.newNode()
+	rnode, err := ing.newNode(node.GetLevel())
 	if err != nil {
 		return base.InvalidPageId, err
 	}
 
+	// 右节点在 node 的右链接更新前对其他线程不可见
+	rnode.Lock()
 	err = node.Split(rnode, off, size, entry, opr)
+	rnode.Unlock()
+	rnode.Release()
 	if err != nil {
 		return base.InvalidPageId, err
 	}
-
-	rnode.Release()
 	return rnode.GetPageId(), nil
 }
 
@@ -530,16 +1253,21 @@ func (ing *Ingens) splitNode(node *nodes.Node, off base.OffsetNumber, size base.
 
 // getNode
 func (ing *Ingens) getNode(pageId base.PageNumber) (*nodes.Node, error) {
-	n, err := ing.bmgr.GetBufferData(fmt.Sprintf("%v", pageId), false)
+	n, err := ing.bmgr.GetBufferData(nodes.PageKey(pageId), false)
 	if err != nil {
 		return nil, err
 	}
 	return n.(*nodes.Node), nil
 }
 
+func (ing *Ingens) getRootId() base.PageNumber {
+	return base.PageNumber(atomic.LoadUint64((*uint64)(&ing.root)))
+}
+
 // 获取根节点，加读锁
+// 获取读锁前根节点可能已经被拆分，之后通过右链接和levels仍然可以找到正确的位置
 func (ing *Ingens) getRoot() (*nodes.Node, error) {
-	n, err := ing.getNode(ing.root)
+	n, err := ing.getNode(ing.getRootId())
 	if err != nil {
 		return nil, err
 	}
@@ -547,23 +1275,49 @@ func (ing *Ingens) getRoot() (*nodes.Node, error) {
 	return n, nil
 }
 
-func (ing *Ingens) newNode() (*nodes.Node, error) {
+// newNode 分配新的页面，缓冲池中的页面可能保存着其他页面的数据，需要初始化
+func (ing *Ingens) newNode(level uint16) (*nodes.Node, error) {
 	pageId := base.PageNumber(atomic.AddUint64((*uint64)(&ing.pageNum), 1))
-	bd, err := ing.bmgr.GetBufferData(fmt.Sprintf("%v", pageId), true)
+	bd, err := ing.bmgr.GetBufferData(nodes.PageKey(pageId), true)
 	if err != nil {
 		return nil, err
 	}
 
-	return bd.(*nodes.Node), nil
+	n := bd.(*nodes.Node)
+	n.Init(pageId, level)
+	return n, nil
 }
 
-func (ing *Ingens) newRoot(level uint16) (*nodes.Node, error) {
-	pageId := base.PageNumber(atomic.AddUint64((*uint64)(&ing.pageNum), 1))
-	n, err := ing.newNode()
+// newRoot 创建新的根节点，加写锁
+// 旧的根节点拆分为自身和 rpageId，新的根节点先指向 rpageId，调用者再插入旧根节点的 IndexEntry
+func (ing *Ingens) newRoot(level uint16, rpageId base.PageNumber) (*nodes.Node, error) {
+	if int(level) >= levelSize {
+		return nil, errTooManyLevels
+	}
+
+	// 右节点的最大 key
+	rnode, err := ing.getNode(rpageId)
 	if err != nil {
 		return nil, err
 	}
+	rnode.RLock()
+	ie := nodes.NewIndexEntry(ing.mmgr, rnode.GetHighKey(), rpageId)
+	rnode.RUnlock()
+	rnode.Release()
+	defer ing.mmgr.Free(ie)
 
-	n.Init(pageId, level)
+	n, err := ing.newNode(level)
+	if err != nil {
+		return nil, err
+	}
+	n.Lock()
+	n.Insert(n.GetEndOff(), ie)
+
+	// 设置新的根节点，meta 在页面写回后持久化
+	ing.metaMu.Lock()
+	ing.levels[level] = n.GetPageId()
+	ing.levelNum = uint64(level) + 1
+	atomic.StoreUint64((*uint64)(&ing.root), uint64(n.GetPageId()))
+	ing.metaMu.Unlock()
 	return n, nil
 }
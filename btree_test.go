@@ -0,0 +1,205 @@
+package ingens
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	test := []struct {
+		name string
+
+		num   int
+		order func(int) []int
+	}{
+		{"ascending", 3000, func(n int) []int {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = i
+			}
+			return s
+		}},
+		{"descending", 3000, func(n int) []int {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = n - 1 - i
+			}
+			return s
+		}},
+		{"random", 3000, func(n int) []int {
+			return rand.New(rand.NewSource(1)).Perm(n)
+		}},
+	}
+
+	// 1KB 的 key 让每个节点只能保存几十个 entry，少量数据就能拆分出多层
+	key := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{'k'}, MaxKeySize-8)...)
+	}
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("value-%d", i))
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			opt := DefaultOptions()
+			opt.BufferCapacity = 64
+
+			ing, err := Open(path, opt)
+			if err != nil {
+				t.Fatalf("Open() err: %v", err)
+			}
+
+			order := tt.order(tt.num)
+			for b := 0; b < len(order); b += 100 {
+				batch := order[b:]
+				if len(batch) > 100 {
+					batch = batch[:100]
+				}
+				err := ing.Exec(func(txn *Txn) error {
+					for _, i := range batch {
+						if err := txn.Set(key(i), value(i)); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Set() err: %v", err)
+				}
+			}
+
+			if ing.levelNum < 3 {
+				t.Errorf("Set() levels: got = %v, want >= 3", ing.levelNum)
+			}
+
+			check := func(ing *Ingens) {
+				err := ing.View(func(txn *Txn) error {
+					for i := 0; i < tt.num; i++ {
+						got, err := txn.Get(key(i))
+						if err != nil {
+							return fmt.Errorf("key %d: %w", i, err)
+						}
+						if !bytes.Equal(got, value(i)) {
+							return fmt.Errorf("key %d: got = %s, want = %s", i, got, value(i))
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Get() err: %v", err)
+				}
+			}
+			check(ing)
+
+			// 重新打开后根节点和每一层最左侧节点从 meta 恢复
+			if err := ing.Close(true); err != nil {
+				t.Fatalf("Close() err: %v", err)
+			}
+			ing, err = Open(path, opt)
+			if err != nil {
+				t.Fatalf("Open() again err: %v", err)
+			}
+			check(ing)
+			ing.Close(true)
+		})
+	}
+}
+
+func TestRollbackKeepsHighKey(t *testing.T) {
+	path := t.TempDir()
+	opt := DefaultOptions()
+	opt.BufferCapacity = 64
+
+	ing, err := Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	defer ing.Close(true)
+
+	key := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{'k'}, MaxKeySize-8)...)
+	}
+
+	// highKeys 返回每个非最右叶子节点的 high key
+	highKeys := func() [][]byte {
+		node, _, err := ing.search(nil)
+		if err != nil {
+			t.Fatalf("search() err: %v", err)
+		}
+		var keys [][]byte
+		for !node.IsRightmost() {
+			if node.GetEndOff() == node.GetBeginOff() {
+				t.Fatalf("leaf %v is empty", node.GetPageId())
+			}
+			keys = append(keys, append([]byte(nil), node.GetHighKey()...))
+			if node, err = ing.moveRight(node, false); err != nil {
+				t.Fatalf("moveRight() err: %v", err)
+			}
+		}
+		node.RUnlock()
+		node.Release()
+		return keys
+	}
+
+	// 回滚的事务插入的 entry 是拆分后左侧节点的 high key
+	txn, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := txn.Set(key(i), key(i)); err != nil {
+			t.Fatalf("Set() err: %v", err)
+		}
+	}
+	want := highKeys()
+	if len(want) == 0 {
+		t.Fatalf("Set() did not split the leaf")
+	}
+	txn.Rollback()
+
+	got := highKeys()
+	if len(got) != len(want) {
+		t.Fatalf("highKeys() after rollback: got = %v leaves, want = %v", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("GetHighKey() leaf %d: got = %.8s, want = %.8s", i, got[i], want[i])
+		}
+	}
+
+	check := func(found bool) {
+		err := ing.View(func(txn *Txn) error {
+			for i := 0; i < 200; i++ {
+				_, err := txn.Get(key(i))
+				if found && err != nil {
+					return fmt.Errorf("key %d: %w", i, err)
+				}
+				if !found && err != ErrNotFoundEntry {
+					return fmt.Errorf("key %d: got = %v, want = %v", i, err, ErrNotFoundEntry)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Get() err: %v", err)
+		}
+	}
+	check(false)
+
+	// 再次插入时落在原来的节点
+	err = ing.Exec(func(txn *Txn) error {
+		for i := 0; i < 200; i++ {
+			if err := txn.Set(key(i), key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() again err: %v", err)
+	}
+	check(true)
+}
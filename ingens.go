@@ -1,6 +1,9 @@
 package ingens
 
 import (
+	"container/list"
+	"context"
+	"encoding/binary"
 	"errors"
 	"github/suixinpr/ingens/base"
 	"github/suixinpr/ingens/manager/buffer"
@@ -20,6 +23,15 @@ import (
 var (
 	// ErrDatabaseIsClosed db is closed
 	ErrDatabaseIsClosed = errors.New("ingens: db is closed")
+
+	// ErrSnapshotTooOld the versions of the snapshot are out of Option.VersionRetention
+	ErrSnapshotTooOld = errors.New("ingens: snapshot too old")
+
+	// ErrSnapshotInFuture the commit sequence number has not been assigned
+	ErrSnapshotInFuture = errors.New("ingens: snapshot in the future")
+
+	// ErrUndoSpaceExhausted the undo log exceeds Option.MaxUndoSize with UndoRejectWrites
+	ErrUndoSpaceExhausted = errors.New("ingens: undo space exhausted")
 )
 
 type Ingens struct {
@@ -30,6 +42,7 @@ type Ingens struct {
 	// btree
 	file     *os.File
 	meta     *meta // meta page 0
+	metaMu   sync.Mutex
 	root     base.PageNumber
 	pageNum  base.PageNumber
 	levelNum uint64
@@ -39,10 +52,20 @@ type Ingens struct {
 	bmgr *buffer.BufferManager
 	mmgr *memory.MemoryManager
 	lmgr *locker.LockerManager
+	rmgr *locker.SIReadManager
 	smgr *nodes.StorageManager
 	tmgr *transaction.TransactionManager
 	umgr *undo.UndoManager
 
+	// purge
+	purgeStats    purgeStats
+	undoExhausted uint32 // UndoRejectWrites 拒绝写入
+	deadEntries   uint64 // 上次 vacuum 之后标记的 dead entry 数量，原子操作
+
+	// transaction
+	txnMu sync.Mutex
+	txns  list.List // 按开始时间排列的事务
+
 	// close
 	closed uint32
 	closeT sync.WaitGroup // transaction
@@ -52,7 +75,8 @@ type Ingens struct {
 
 // Open open database and return a Ingens instanse
 func Open(path string, opt Option) (*Ingens, error) {
-	var ing = &Ingens{closed: 0, opt: &opt}
+	// 重启之前标记的 dead entry 数量未知，第一次回收时遍历所有叶子节点
+	var ing = &Ingens{closed: 0, opt: &opt, closeC: make(chan struct{}), deadEntries: 1}
 	var err error
 
 	if err := ing.opt.Check(); err != nil {
@@ -64,6 +88,7 @@ func Open(path string, opt Option) (*Ingens, error) {
 	if err != nil {
 		return nil, err
 	}
+	ing.smgr = nodes.NewStorageManager(ing.file)
 
 	// meta 页面读取
 	if info, err := ing.file.Stat(); err != nil {
@@ -79,12 +104,33 @@ func Open(path string, opt Option) (*Ingens, error) {
 	}
 
 	// btree
-	if err := ing.initBtree(); err != nil {
+	ing.initBtree()
+
+	// manager
+	ing.mmgr = memory.NewMemoryManager(ing.opt.MinSize, ing.opt.MaxSize)
+	ing.lmgr = locker.NewLockerManager(256, ing.opt.Timeout)
+	ing.rmgr = locker.NewSIReadManager()
+	clog, err := transaction.OpenCommitLog(path)
+	if err != nil {
+		return nil, err
+	}
+	ing.tmgr = transaction.NewTransactionManager(ing.opt.VersionRetention, clog)
+	if err := ing.tmgr.Recover(ing.meta.tid, ing.meta.csn); err != nil {
+		return nil, err
+	}
+	ing.umgr, err = undo.OpenUndoManager(path)
+	if err != nil {
+		return nil, err
+	}
+	// 节点页面写回之前先写回 undo，崩溃后才能回滚页面上未提交的修改
+	ing.smgr.SetWriteAhead(ing.umgr.Flush)
+	if err := ing.recover(); err != nil {
 		return nil, err
 	}
 
-	ing.closeB.Add(1)
+	ing.closeB.Add(2)
 	go ing.autoFlush()
+	go ing.autoPurge()
 
 	return ing, nil
 }
@@ -107,6 +153,12 @@ func (ing *Ingens) Close(wait bool) error {
 	// wait background
 	ing.closeB.Wait()
 
+	if err := ing.tmgr.Close(); err != nil {
+		return err
+	}
+	if err := ing.umgr.Close(); err != nil {
+		return err
+	}
 	return ing.file.Close()
 }
 
@@ -115,8 +167,39 @@ func (ing *Ingens) isClosed() bool {
 	return atomic.LoadUint32(&ing.closed) == 1
 }
 
-// Begin begin a transation
+// Begin begin a transation with the default options
 func (ing *Ingens) Begin() (*Txn, error) {
+	return ing.BeginTx(TxnOptions{})
+}
+
+// BeginReadOnly begin a read-only transation, it reads a consistent snapshot
+// but never allocates a transaction id or locks entries, writes return ErrTxnReadOnly
+func (ing *Ingens) BeginReadOnly() (*Txn, error) {
+	return ing.BeginTx(TxnOptions{ReadOnly: true})
+}
+
+// BeginTx begin a transation with opts
+func (ing *Ingens) BeginTx(opts TxnOptions) (*Txn, error) {
+	return ing.BeginTxContext(context.Background(), opts)
+}
+
+// BeginTxContext begin a transation with opts
+// operations return ctx.Err() after ctx is done, and the transaction is rolled
+// back if it has not been committed
+func (ing *Ingens) BeginTxContext(ctx context.Context, opts TxnOptions) (*Txn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.Isolation == DefaultIsolation {
+		opts.Isolation = ing.opt.Isolation
+	}
+	if opts.Isolation > Serializable {
+		return nil, ErrUnknownIsolation
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = ing.opt.Timeout
+	}
+
 	if ing.isClosed() {
 		return nil, ErrDatabaseIsClosed
 	}
@@ -129,63 +212,273 @@ func (ing *Ingens) Begin() (*Txn, error) {
 
 	txn := &Txn{
 		ing:      ing,
+		ctx:      ctx,
 		tid:      base.InvalidTid,
 		snapshot: ing.tmgr.GetSnapshot(),
+
+		isolation: opts.Isolation,
+		readOnly:  opts.ReadOnly,
+		timeout:   opts.Timeout,
+
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	ing.registerTxn(txn)
+
+	if txn.isolation == Serializable {
+		txn.sxact = ing.rmgr.Register(txn.snapshot.Csn(), opts.Priority)
+	}
+
+	// ctx 可能被取消时，结束后回滚
+	if ctx.Done() != nil {
+		go txn.watch()
 	}
 
 	return txn, nil
 }
 
-func (ing *Ingens) Exec(fn func(*Txn) error) error {
+// BeginAt begin a read-only transation that reads the database as it was
+// after the commit csn, csn must be within Option.VersionRetention
+func (ing *Ingens) BeginAt(csn base.CommitSequenceNumber) (*Txn, error) {
+	if csn > ing.tmgr.LatestCsn() {
+		return nil, ErrSnapshotInFuture
+	}
+
+	if ing.isClosed() {
+		return nil, ErrDatabaseIsClosed
+	}
+
+	ing.closeT.Add(1)
+	if ing.isClosed() {
+		ing.closeT.Done()
+		return nil, ErrDatabaseIsClosed
+	}
+
+	snapshot, ok := ing.tmgr.GetSnapshotAt(csn)
+	if !ok {
+		ing.closeT.Done()
+		return nil, ErrSnapshotTooOld
+	}
+
+	// 历史快照只能读取
+	txn := &Txn{
+		ing:      ing,
+		ctx:      context.Background(),
+		tid:      base.InvalidTid,
+		snapshot: snapshot,
+
+		isolation: SnapshotIsolation,
+		readOnly:  true,
+		timeout:   ing.opt.Timeout,
+
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	ing.registerTxn(txn)
+
+	return txn, nil
+}
+
+// BeginAsOf begin a read-only transation that reads the database as it was at t
+// commit times are kept at millisecond resolution, commits in the same
+// millisecond as t may not be visible
+func (ing *Ingens) BeginAsOf(t time.Time) (*Txn, error) {
+	csn, ok := ing.tmgr.CsnAsOf(t)
+	if !ok {
+		return nil, ErrSnapshotTooOld
+	}
+	return ing.BeginAt(csn)
+}
+
+// registerTxn 登记事务，回收线程从中选择运行时间最长的事务
+func (ing *Ingens) registerTxn(txn *Txn) {
+	ing.txnMu.Lock()
+	txn.elem = ing.txns.PushBack(txn)
+	ing.txnMu.Unlock()
+}
+
+func (ing *Ingens) unregisterTxn(txn *Txn) {
+	ing.txnMu.Lock()
+	ing.txns.Remove(txn.elem)
+	ing.txnMu.Unlock()
+}
+
+// oldestTxn 返回最早开始并且没有被回滚的事务
+func (ing *Ingens) oldestTxn() *Txn {
+	ing.txnMu.Lock()
+	defer ing.txnMu.Unlock()
+
+	for e := ing.txns.Front(); e != nil; e = e.Next() {
+		if txn := e.Value.(*Txn); atomic.LoadUint32(&txn.invalid) == 0 {
+			return txn
+		}
+	}
 	return nil
 }
 
+// expiredTxns 返回运行时间超过 age 并且没有被回滚的事务
+func (ing *Ingens) expiredTxns(age time.Duration) []*Txn {
+	ing.txnMu.Lock()
+	defer ing.txnMu.Unlock()
+
+	var txns []*Txn
+	for e := ing.txns.Front(); e != nil; e = e.Next() {
+		txn := e.Value.(*Txn)
+		if atomic.LoadUint32(&txn.invalid) == 0 && time.Since(txn.start) > age {
+			txns = append(txns, txn)
+		}
+	}
+	return txns
+}
+
+// Exec run fn in a transaction
+// the transaction is committed if fn returns nil, and rolled back if fn
+// returns an error or panics. Retryable errors are retried up to
+// Option.RetryTimes times with exponential backoff
+func (ing *Ingens) Exec(fn func(*Txn) error) error {
+	return ing.retry(func() error {
+		txn, err := ing.Begin()
+		if err != nil {
+			return err
+		}
+		return txn.run(fn)
+	})
+}
+
+// View run fn in a read-only transaction, writes in fn return ErrTxnReadOnly
+func (ing *Ingens) View(fn func(*Txn) error) error {
+	return ing.retry(func() error {
+		txn, err := ing.BeginReadOnly()
+		if err != nil {
+			return err
+		}
+
+		// 提交而不是回滚，可串行化事务需要在提交时检查读到的结果
+		return txn.run(fn)
+	})
+}
+
+// retry 执行fn，遇到可重试的错误时等待后重试
+func (ing *Ingens) retry(fn func() error) error {
+	backoff := ing.opt.RetryBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= ing.opt.RetryTimes || !isRetryable(err) {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isRetryable 判断错误是否由并发冲突导致，重新执行事务可能成功
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrLockEntryTimeout) || errors.Is(err, ErrWriteConflict) ||
+		errors.Is(err, ErrSerializationFailure)
+}
+
 func (ing *Ingens) init() error {
 	// 初始化2个页面，分别为meta和root页面
-	var err error
-
-	buf := make([]byte, PageSize)
+	buf := make([]byte, base.PageSize)
 	meta := (*meta)(unsafe.Pointer(&buf[0]))
 	meta.magic = magic
 	meta.version = version
 	meta.status = 0
 	meta.tid = 0
+	meta.csn = 0
 	meta.root = 1
-	err = storage.Write(ing.file, 0, buf)
-	if err != nil {
+	meta.pageNum = 1
+	ing.meta = meta
+	ing.metaLevels()[0] = 1
+
+	root := ing.smgr.InitData().(*nodes.Node)
+	root.Init(1, 0)
+	if err := ing.smgr.Write(nodes.PageKey(1), root); err != nil {
 		return err
 	}
 
-	root := btree.EmptryPage(1, 0)
-	err = btree.WritePage(ing.file, root)
+	binary.BigEndian.PutUint64(buf[base.PageDataUpper:], storage.Sum64(buf[:base.PageDataUpper]))
+	return storage.Write(ing.file, 0, buf)
+}
+
+// recover 回滚重启时中断的事务
+// 先写回回滚后的页面，再在 commit log 中标记为回滚，之后回收才能删除它们的回滚记录
+func (ing *Ingens) recover() error {
+	tids, err := ing.tmgr.Unfinished()
 	if err != nil {
 		return err
 	}
+	unfinished := make(map[base.TransactionId]bool, len(tids))
+	for _, tid := range tids {
+		unfinished[tid] = true
+	}
 
-	ing.meta = meta
-	return nil
+	if err := ing.umgr.Recover(func(tid base.TransactionId) bool { return unfinished[tid] }); err != nil {
+		return err
+	}
+	if len(tids) == 0 {
+		return nil
+	}
+
+	for _, tid := range tids {
+		if err := ing.rollback(tid, base.InvalidUndoRecordPtr); err != nil {
+			return err
+		}
+	}
+	if err := ing.bmgr.Flush(); err != nil {
+		return err
+	}
+	if err := ing.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, tid := range tids {
+		ing.tmgr.AbortTransaction(tid, nil)
+	}
+	return ing.tmgr.Flush()
 }
 
 // 初始化
-func (ing *Ingens) initBtree() error {
-	var err error
-	ing.btree = &btree{ing: ing}
-	ing.btree.root = ing.meta.root
-	ing.btree.pageNum = ing.meta.pageNum
-	copy(ing.btree.levels,
-		unsafe.Slice((*PageNumber)(unsafe.Pointer(uintptr(unsafe.Pointer(ing.meta))+uintptr(metaSize))), levelSize))
-	ing.btree.bufPool, err = buffer.NewBufferPool(2048, 256) // 2048 * 64KB = 128MB
-	return err
+func (ing *Ingens) initBtree() {
+	ing.root = ing.meta.root
+	ing.pageNum = ing.meta.pageNum
+	ing.levels = make([]base.PageNumber, levelSize)
+	copy(ing.levels, ing.metaLevels())
+	for ing.levelNum < levelSize && ing.levels[ing.levelNum] != base.InvalidPageId {
+		ing.levelNum++
+	}
+
+	ing.bmgr = buffer.NewBufferPool(ing.opt.BufferCapacity, ing.opt.BufferBucketNum, base.PageSize, ing.smgr)
+	ing.smgr.SetBufferManager(ing.bmgr)
+}
+
+// flush 依次写回 commit log、undo、btree 的页面，最后写回 meta
+func (ing *Ingens) flush() error {
+	if err := ing.tmgr.Flush(); err != nil {
+		return err
+	}
+	if err := ing.umgr.Flush(); err != nil {
+		return err
+	}
+	if err := ing.bmgr.Flush(); err != nil {
+		return err
+	}
+	return ing.writeMeta()
 }
 
 func (ing *Ingens) autoFlush() {
 	for {
 		select {
 		case <-time.After(time.Millisecond * 100):
-			ing.btree.bufPool.Flush()
+			ing.flush()
 		case <-ing.closeC:
 			ing.closeT.Wait()
-			ing.btree.bufPool.Flush()
+			// 所有事务都已经结束，预留而没有分配的 tid 不需要保留
+			ing.metaMu.Lock()
+			atomic.StoreUint64((*uint64)(&ing.meta.tid), uint64(ing.tmgr.LatestTid()))
+			ing.metaMu.Unlock()
+			ing.flush()
 			ing.closeB.Done()
 			return
 		}
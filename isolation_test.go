@@ -0,0 +1,497 @@
+package ingens
+
+import (
+	"fmt"
+	"github/suixinpr/ingens/base"
+	"testing"
+	"time"
+)
+
+func TestWriteConflict(t *testing.T) {
+	test := []struct {
+		name string
+
+		other  func(txn *Txn) error // 并发事务的修改
+		commit bool                 // 并发事务是否在 txn 写入之前提交
+		write  func(txn *Txn) error
+		err    error
+	}{
+		{"set after commit", func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("1"))
+		}, true, func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("2"))
+		}, ErrWriteConflict},
+		{"set after uncommitted set", func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("1"))
+		}, false, func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("2"))
+		}, ErrWriteConflict},
+		{"delete after delete", func(txn *Txn) error {
+			return txn.Delete([]byte("a"))
+		}, true, func(txn *Txn) error {
+			return txn.Delete([]byte("a"))
+		}, ErrWriteConflict},
+		{"insert after insert", func(txn *Txn) error {
+			return txn.Set([]byte("c"), []byte("1"))
+		}, true, func(txn *Txn) error {
+			return txn.Set([]byte("c"), []byte("2"))
+		}, ErrWriteConflict},
+		{"delete range after update", func(txn *Txn) error {
+			return txn.Update([]byte("b"), []byte("1"))
+		}, true, func(txn *Txn) error {
+			return txn.DeleteRange([]byte("a"), nil)
+		}, ErrWriteConflict},
+		{"different keys", func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("1"))
+		}, true, func(txn *Txn) error {
+			return txn.Set([]byte("b"), []byte("2"))
+		}, nil},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			err := ing.Exec(func(txn *Txn) error {
+				if err := txn.Set([]byte("a"), []byte("0")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("b"), []byte("0"))
+			})
+			if err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			defer txn.Rollback()
+
+			other, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			defer other.Rollback()
+			if err := tt.other(other); err != nil {
+				t.Fatalf("other() err: %v", err)
+			}
+			if tt.commit {
+				if err := other.Commit(); err != nil {
+					t.Fatalf("Commit() err: %v", err)
+				}
+			}
+
+			// 先提交者获胜，快照之后的修改不能被覆盖
+			if err := tt.write(txn); err != tt.err {
+				t.Errorf("write() err: got = %v, want = %v", err, tt.err)
+			}
+		})
+	}
+
+	// 快照之前提交的修改可以覆盖
+	ing := openTest(t, DefaultOptions())
+	defer ing.Close(true)
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("1")) }); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("2")) }); err != nil {
+		t.Errorf("Set() after commit err: %v", err)
+	}
+}
+
+func TestWriteSkew(t *testing.T) {
+	test := []struct {
+		name string
+
+		isolation IsolationLevel
+		fail      bool // 是否有事务因为不可串行化回滚
+	}{
+		{"snapshot", SnapshotIsolation, false},
+		{"serializable", Serializable, true},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			err := ing.Exec(func(txn *Txn) error {
+				if err := txn.Set([]byte("x"), []byte("1")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("y"), []byte("1"))
+			})
+			if err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			// 两个事务都读取 x 和 y，分别把其中一个改为 0
+			var txns [2]*Txn
+			for i, key := range []string{"x", "y"} {
+				txn, err := ing.BeginTx(TxnOptions{Isolation: tt.isolation})
+				if err != nil {
+					t.Fatalf("BeginTx() err: %v", err)
+				}
+				defer txn.Rollback()
+				txns[i] = txn
+
+				values, errs := txn.MultiGet([][]byte{[]byte("x"), []byte("y")})
+				if errs[0] != nil || errs[1] != nil || string(values[0]) != "1" || string(values[1]) != "1" {
+					t.Fatalf("MultiGet(): got = %q, %v", values, errs)
+				}
+				if err := txn.Set([]byte(key), []byte("0")); err != nil {
+					t.Fatalf("Set() err: %v", err)
+				}
+			}
+
+			failed := false
+			for _, txn := range txns {
+				switch err := txn.Commit(); err {
+				case nil:
+				case ErrSerializationFailure:
+					failed = true
+				default:
+					t.Fatalf("Commit() err: %v", err)
+				}
+			}
+			if failed != tt.fail {
+				t.Errorf("Commit() serialization failure: got = %v, want = %v", failed, tt.fail)
+			}
+		})
+	}
+}
+
+func TestIsolationLevel(t *testing.T) {
+	test := []struct {
+		name string
+
+		isolation IsolationLevel
+		read      string // 并发事务提交后读到的值
+		write     error  // 并发事务提交后覆盖同一个 key 的结果
+	}{
+		{"read committed", ReadCommitted, "1", nil},
+		{"snapshot", SnapshotIsolation, "0", ErrWriteConflict},
+		{"serializable", Serializable, "0", ErrWriteConflict},
+		{"default", DefaultIsolation, "0", ErrWriteConflict},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("0")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.BeginTx(TxnOptions{Isolation: tt.isolation})
+			if err != nil {
+				t.Fatalf("BeginTx() err: %v", err)
+			}
+			defer txn.Rollback()
+			if got, err := txn.Get([]byte("a")); err != nil || string(got) != "0" {
+				t.Fatalf("Get(): got = %s, %v, want = 0", got, err)
+			}
+
+			// 读已提交的每条语句使用新的快照，读到之后提交的修改
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("1")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+			if got, err := txn.Get([]byte("a")); err != nil || string(got) != tt.read {
+				t.Errorf("Get(): got = %s, %v, want = %s", got, err, tt.read)
+			}
+			if err := txn.Set([]byte("a"), []byte("2")); err != tt.write {
+				t.Errorf("Set() err: got = %v, want = %v", err, tt.write)
+			}
+		})
+	}
+
+	ing := openTest(t, DefaultOptions())
+	defer ing.Close(true)
+	if _, err := ing.BeginTx(TxnOptions{Isolation: Serializable + 1}); err != ErrUnknownIsolation {
+		t.Errorf("BeginTx() err: got = %v, want = %v", err, ErrUnknownIsolation)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	test := []struct {
+		name  string
+		write func(txn *Txn) error
+	}{
+		{"Set", func(txn *Txn) error { return txn.Set([]byte("a"), []byte("1")) }},
+		{"Setnx", func(txn *Txn) error { return txn.Setnx([]byte("b"), []byte("1")) }},
+		{"Update", func(txn *Txn) error { return txn.Update([]byte("a"), []byte("1")) }},
+		{"GetSet", func(txn *Txn) error {
+			_, err := txn.GetSet([]byte("a"), []byte("1"))
+			return err
+		}},
+		{"CompareAndSwap", func(txn *Txn) error {
+			_, err := txn.CompareAndSwap([]byte("a"), []byte("0"), []byte("1"))
+			return err
+		}},
+		{"IncrBy", func(txn *Txn) error {
+			_, err := txn.IncrBy([]byte("n"), 1)
+			return err
+		}},
+		{"Delete", func(txn *Txn) error { return txn.Delete([]byte("a")) }},
+		{"DeleteRange", func(txn *Txn) error { return txn.DeleteRange([]byte("a"), nil) }},
+		{"Write", func(txn *Txn) error {
+			wb := NewWriteBatch()
+			wb.Put([]byte("a"), []byte("1"))
+			return txn.Write(wb)
+		}},
+	}
+
+	ing := openTest(t, DefaultOptions())
+	defer ing.Close(true)
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("0")) }); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			txn, err := ing.BeginReadOnly()
+			if err != nil {
+				t.Fatalf("BeginReadOnly() err: %v", err)
+			}
+
+			if err := tt.write(txn); err != ErrTxnReadOnly {
+				t.Errorf("write() err: got = %v, want = %v", err, ErrTxnReadOnly)
+			}
+
+			// 只读事务可以读取，不分配 tid
+			if got, err := txn.Get([]byte("a")); err != nil || string(got) != "0" {
+				t.Errorf("Get(): got = %s, %v, want = 0", got, err)
+			}
+			if txn.tid != base.InvalidTid {
+				t.Errorf("tid: got = %v, want = %v", txn.tid, base.InvalidTid)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Errorf("Commit() err: %v", err)
+			}
+		})
+	}
+
+	if err := checkValues(ing, map[string]string{"a": "0", "b": "", "n": ""}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBeginAt(t *testing.T) {
+	opt := DefaultOptions()
+	opt.VersionRetention = 200 * time.Millisecond
+	ing := openTest(t, opt)
+	defer ing.Close(true)
+
+	// 依次写入 4 个版本，第 3 个版本删除 key
+	versions := []string{"1", "2", "", "4"}
+	csns := make([]base.CommitSequenceNumber, len(versions))
+	times := make([]time.Time, len(versions))
+	for i, v := range versions {
+		err := ing.Exec(func(txn *Txn) error {
+			if v == "" {
+				return txn.Delete([]byte("a"))
+			}
+			return txn.Set([]byte("a"), []byte(v))
+		})
+		if err != nil {
+			t.Fatalf("Exec() err: %v", err)
+		}
+		csns[i] = ing.tmgr.LatestCsn()
+		times[i] = time.Now()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	get := func(txn *Txn) string {
+		defer txn.Rollback()
+		got, err := txn.Get([]byte("a"))
+		if err == ErrNotFoundEntry {
+			return ""
+		}
+		if err != nil {
+			t.Errorf("Get() err: %v", err)
+		}
+		return string(got)
+	}
+	for i, want := range versions {
+		txn, err := ing.BeginAt(csns[i])
+		if err != nil {
+			t.Fatalf("BeginAt(%v) err: %v", csns[i], err)
+		}
+		if err := txn.Set([]byte("a"), []byte("x")); err != ErrTxnReadOnly {
+			t.Errorf("Set() err: got = %v, want = %v", err, ErrTxnReadOnly)
+		}
+		if got := get(txn); got != want {
+			t.Errorf("BeginAt(%v) Get(): got = %q, want = %q", csns[i], got, want)
+		}
+
+		txn, err = ing.BeginAsOf(times[i])
+		if err != nil {
+			t.Fatalf("BeginAsOf() err: %v", err)
+		}
+		if got := get(txn); got != want {
+			t.Errorf("BeginAsOf(%v) Get(): got = %q, want = %q", i, got, want)
+		}
+	}
+
+	if _, err := ing.BeginAt(csns[len(csns)-1] + 1); err != ErrSnapshotInFuture {
+		t.Errorf("BeginAt() future err: got = %v, want = %v", err, ErrSnapshotInFuture)
+	}
+
+	// 超出保留期限之后不能再读取
+	time.Sleep(2 * opt.VersionRetention)
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("b"), []byte("1")) }); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+	if _, err := ing.BeginAt(csns[0]); err != ErrSnapshotTooOld {
+		t.Errorf("BeginAt() too old err: got = %v, want = %v", err, ErrSnapshotTooOld)
+	}
+	if _, err := ing.BeginAsOf(times[0]); err != ErrSnapshotTooOld {
+		t.Errorf("BeginAsOf() too old err: got = %v, want = %v", err, ErrSnapshotTooOld)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	test := []struct {
+		name string
+
+		key   string
+		write func(txn *Txn) error
+		own   string // 事务自己读到的值，"" 表示不存在
+	}{
+		{"insert", "b", func(txn *Txn) error { return txn.Set([]byte("b"), []byte("1")) }, "1"},
+		{"update", "a", func(txn *Txn) error { return txn.Set([]byte("a"), []byte("1")) }, "1"},
+		{"update twice", "a", func(txn *Txn) error {
+			if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("a"), []byte("2"))
+		}, "2"},
+		{"delete", "a", func(txn *Txn) error { return txn.Delete([]byte("a")) }, ""},
+		{"delete and insert", "a", func(txn *Txn) error {
+			if err := txn.Delete([]byte("a")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("a"), []byte("1"))
+		}, "1"},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("a"), []byte("0")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+			before := scanKeys(t, ing)
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			defer txn.Rollback()
+			if err := tt.write(txn); err != nil {
+				t.Fatalf("write() err: %v", err)
+			}
+
+			// 事务读到自己的修改，Get、MultiGet 和迭代器的结果相同
+			key := tt.key
+			got, err := txn.Get([]byte(key))
+			if (tt.own == "") != (err == ErrNotFoundEntry) || string(got) != tt.own {
+				t.Errorf("Get(): got = %q, %v, want = %q", got, err, tt.own)
+			}
+			values, _ := txn.MultiGet([][]byte{[]byte(key)})
+			if string(values[0]) != tt.own {
+				t.Errorf("MultiGet(): got = %q, want = %q", values[0], tt.own)
+			}
+			it := txn.ScanPrefix([]byte(key))
+			if it.Valid() != (tt.own != "") || (it.Valid() && string(it.Value()) != tt.own) {
+				t.Errorf("ScanPrefix(): valid = %v, want = %q", it.Valid(), tt.own)
+			}
+
+			// 未提交和回滚的修改对其他事务不可见
+			if got := scanKeys(t, ing); fmt.Sprint(got) != fmt.Sprint(before) {
+				t.Errorf("keys before commit: got = %q, want = %q", got, before)
+			}
+			if err := checkValues(ing, map[string]string{"a": "0", "b": ""}); err != nil {
+				t.Error(err)
+			}
+			txn.Rollback()
+			if err := checkValues(ing, map[string]string{"a": "0", "b": ""}); err != nil {
+				t.Errorf("after rollback: %v", err)
+			}
+		})
+	}
+}
+
+func TestVersionChain(t *testing.T) {
+	ing := openTest(t, DefaultOptions())
+	defer ing.Close(true)
+
+	// 每个提交之后开始一个快照事务，key a 的版本链上依次是：不存在、1、3、删除、5
+	// 同一个事务多次写入同一个 key 时版本链上有该事务的多个版本
+	writes := []func(txn *Txn) error{
+		func(txn *Txn) error { return txn.Set([]byte("b"), []byte("0")) },
+		func(txn *Txn) error { return txn.Set([]byte("a"), []byte("1")) },
+		func(txn *Txn) error {
+			if err := txn.Set([]byte("a"), []byte("2")); err != nil {
+				return err
+			}
+			return txn.Update([]byte("a"), []byte("3"))
+		},
+		func(txn *Txn) error { return txn.Delete([]byte("a")) },
+		func(txn *Txn) error {
+			if err := txn.Set([]byte("a"), []byte("4")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("a"), []byte("5"))
+		},
+	}
+	versions := []string{"", "1", "3", "", "5"}
+
+	snapshots := make([]*Txn, len(writes))
+	for i, write := range writes {
+		if err := ing.Exec(write); err != nil {
+			t.Fatalf("Exec(%d) err: %v", i, err)
+		}
+		txn, err := ing.Begin()
+		if err != nil {
+			t.Fatalf("Begin() err: %v", err)
+		}
+		defer txn.Rollback()
+		snapshots[i] = txn
+	}
+
+	// 快照事务仍在运行，回收不能移除它们需要的旧版本
+	if err := ing.purge(); err != nil {
+		t.Fatalf("purge() err: %v", err)
+	}
+
+	// 从新到旧读取，每个快照沿版本链找到自己的版本
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		txn, want := snapshots[i], versions[i]
+
+		got, err := txn.Get([]byte("a"))
+		if (want == "") != (err == ErrNotFoundEntry) || string(got) != want {
+			t.Errorf("snapshot %d Get(): got = %q, %v, want = %q", i, got, err, want)
+		}
+
+		var keys []string
+		it := txn.ScanPrefix(nil)
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("snapshot %d Scan() err: %v", i, err)
+		}
+		wantKeys := []string{"b=0"}
+		if want != "" {
+			wantKeys = []string{"a=" + want, "b=0"}
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(wantKeys) {
+			t.Errorf("snapshot %d Scan(): got = %v, want = %v", i, keys, wantKeys)
+		}
+	}
+}
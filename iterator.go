@@ -0,0 +1,437 @@
+package ingens
+
+import (
+	"bytes"
+	"errors"
+	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/nodes"
+)
+
+var (
+	// errBrokenLeafChain the left sibling cannot reach the current leaf
+	errBrokenLeafChain = errors.New("ingens: broken leaf chain")
+)
+
+// IterOptions specifies the key range of an iterator
+// Lower is inclusive and Upper is exclusive, nil means unbounded
+type IterOptions struct {
+	Lower []byte
+	Upper []byte
+}
+
+// Iterator iterates over the keys visible to the snapshot of a transaction
+// in ascending or descending order
+//
+// The iterator does not hold any lock between calls. It copies the visible
+// entries of one leaf at a time and remembers the page id of that leaf and
+// the keys at both ends of the copy. The leaf may split before the next call
+// and move those keys to a new right sibling, so the iterator first moves
+// right from the remembered page to the leaf whose high key covers the end
+// key, and continues from the position of that key there.
+//
+// Left links are only a hint: after a split the left link of the old right
+// sibling still points to the split page. Moving left therefore goes to the
+// page named by the left link and then moves right again until it reaches
+// the page whose right link is the page we came from.
+type Iterator struct {
+	txn *Txn
+	opt IterOptions
+
+	pageId base.PageNumber // 当前缓存的叶子节点
+	items  []iterItem      // 当前叶子节点中快照可见的 entry，按 key 升序
+	pos    int
+	eof    bool // 右侧没有更多 entry，已经到达最右节点或上界
+	bof    bool // 左侧没有更多 entry，已经到达最左节点或下界
+	err    error
+}
+
+type iterItem struct {
+	key   []byte
+	value []byte
+}
+
+// NewIterator create an iterator, Seek or SeekForPrev should be called before use
+func (txn *Txn) NewIterator(opt IterOptions) *Iterator {
+	return &Iterator{txn: txn, opt: opt, eof: true, bof: true}
+}
+
+// ScanPrefix create an iterator over all keys with the given prefix
+// and move to the first of them
+func (txn *Txn) ScanPrefix(prefix []byte) *Iterator {
+	it := txn.NewIterator(IterOptions{Lower: prefix, Upper: prefixSuccessor(prefix)})
+	it.Seek(prefix)
+	return it
+}
+
+// prefixSuccessor 返回大于所有以 prefix 开头的 key 的最小 key
+// prefix 全部为 0xff 时没有上界，返回 nil
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// Seek move to the first key that is greater than or equal to key
+func (it *Iterator) Seek(key []byte) {
+	if it.opt.Lower != nil && bytes.Compare(key, it.opt.Lower) < 0 {
+		key = it.opt.Lower
+	}
+	it.reset()
+
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+
+	if err := it.txn.check(false); err != nil {
+		it.err = err
+		return
+	}
+	it.txn.beginStatement()
+
+	// 可串行化事务记录扫描的范围
+	if it.txn.sxact != nil {
+		it.txn.ing.rmgr.ReadRange(it.txn.sxact, key, it.opt.Upper)
+	}
+
+	// 下降到叶子节点
+	node, _, err := it.txn.ing.search(key)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	// 右移
+	node, err = it.txn.ing.moveRightForDown(node, key, false)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	off, _ := node.BinarySearch(key)
+	it.load(node, off)
+}
+
+// SeekForPrev move to the last key that is less than or equal to key
+func (it *Iterator) SeekForPrev(key []byte) {
+	inclusive := true
+	if it.opt.Upper != nil && bytes.Compare(key, it.opt.Upper) >= 0 {
+		key, inclusive = it.opt.Upper, false
+	}
+	it.reset()
+
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+
+	if err := it.txn.check(false); err != nil {
+		it.err = err
+		return
+	}
+	it.txn.beginStatement()
+
+	// 可串行化事务记录扫描的范围
+	if it.txn.sxact != nil {
+		upper := key
+		if inclusive {
+			upper = append(append(make([]byte, 0, len(key)+1), key...), 0)
+		}
+		it.txn.ing.rmgr.ReadRange(it.txn.sxact, it.opt.Lower, upper)
+	}
+
+	// 下降到叶子节点
+	node, _, err := it.txn.ing.search(key)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	// 右移
+	node, err = it.txn.ing.moveRightForDown(node, key, false)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	off, found := node.BinarySearch(key)
+	if found && inclusive {
+		off += nodes.EntryPtrSize
+	}
+	it.loadPrev(node, off)
+}
+
+// Next move to the next key
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+
+	it.pos++
+	if it.pos < len(it.items) || it.eof {
+		return
+	}
+
+	// 当前叶子节点已经遍历完，从上一个 key 之后继续
+	last := it.items[len(it.items)-1].key
+	it.reset()
+
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+
+	if err := it.txn.check(false); err != nil {
+		it.err = err
+		return
+	}
+
+	// 当前节点可能已经拆分，last 之后的 entry 可能已经移动到右侧节点
+	node, err := it.relocate(last)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	off, found := node.BinarySearch(last)
+	if found {
+		off += nodes.EntryPtrSize
+	}
+	it.load(node, off)
+}
+
+// Prev move to the previous key
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+
+	it.pos--
+	if it.pos >= 0 || it.bof {
+		return
+	}
+
+	// 当前叶子节点已经遍历完，从上一个 key 之前继续
+	first := it.items[0].key
+	it.reset()
+
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+
+	if err := it.txn.check(false); err != nil {
+		it.err = err
+		return
+	}
+
+	// 当前节点可能已经拆分，first 之前的 entry 可能已经移动到右侧节点
+	node, err := it.relocate(first)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	off, _ := node.BinarySearch(first)
+	it.loadPrev(node, off)
+}
+
+// Valid return whether the iterator is positioned at a key
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.items)
+}
+
+// Key return the key at the current position
+func (it *Iterator) Key() []byte {
+	return it.items[it.pos].key
+}
+
+// Value return the value at the current position
+func (it *Iterator) Value() []byte {
+	return it.items[it.pos].value
+}
+
+// Err return the error that stopped the iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// relocate 从缓存的叶子节点右移到 key 所在的叶子节点，返回时持有读锁
+func (it *Iterator) relocate(key []byte) (*nodes.Node, error) {
+	node, err := it.txn.ing.getNode(it.pageId)
+	if err != nil {
+		return nil, err
+	}
+	node.RLock()
+	return it.txn.ing.moveRightForDown(node, key, false)
+}
+
+func (it *Iterator) reset() {
+	it.items = it.items[:0]
+	it.pos = 0
+	it.eof = false
+	it.bof = false
+	it.err = nil
+}
+
+// load 从 node 的 off 处开始收集快照可见的 entry，直到找到至少一个 entry
+// 调用时 node 持有读锁，返回时释放
+func (it *Iterator) load(node *nodes.Node, off base.OffsetNumber) {
+	ing := it.txn.ing
+	for {
+		for ; off < node.GetEndOff(); off += nodes.EntryPtrSize {
+			de := node.GetDataEntry(off)
+			if it.opt.Upper != nil && bytes.Compare(de.Key(), it.opt.Upper) >= 0 {
+				it.eof = true
+				break
+			}
+
+			// 查找可见版本
+			de, err := ing.visibleDataEntry(it.txn, de)
+			if err != nil {
+				it.err = err
+				node.RUnlock()
+				node.Release()
+				return
+			}
+			if de == nil || de.IsDead() {
+				continue
+			}
+
+			item := iterItem{
+				key:   make([]byte, de.KeySize()),
+				value: make([]byte, de.ValueSize()),
+			}
+			copy(item.key, de.Key())
+			copy(item.value, de.Value())
+			it.items = append(it.items, item)
+		}
+
+		if node.IsRightmost() {
+			it.eof = true
+		}
+		if it.eof || len(it.items) > 0 {
+			break
+		}
+
+		// 请求取消时停止遍历
+		if err := it.txn.ctx.Err(); err != nil {
+			it.err = err
+			node.RUnlock()
+			node.Release()
+			return
+		}
+
+		// 右移
+		var err error
+		node, err = ing.moveRight(node, false)
+		if err != nil {
+			it.err = err
+			return
+		}
+		off = node.GetBeginOff()
+	}
+
+	it.pageId = node.GetPageId()
+	node.RUnlock()
+	node.Release()
+}
+
+// loadPrev 收集 node 中 end 之前快照可见的 entry，直到找到至少一个 entry
+// 调用时 node 持有读锁，返回时释放
+func (it *Iterator) loadPrev(node *nodes.Node, end base.OffsetNumber) {
+	ing := it.txn.ing
+	for {
+		for off := end; off > node.GetBeginOff(); {
+			off -= nodes.EntryPtrSize
+
+			de := node.GetDataEntry(off)
+			if it.opt.Lower != nil && bytes.Compare(de.Key(), it.opt.Lower) < 0 {
+				it.bof = true
+				break
+			}
+
+			// 查找可见版本
+			de, err := ing.visibleDataEntry(it.txn, de)
+			if err != nil {
+				it.err = err
+				node.RUnlock()
+				node.Release()
+				return
+			}
+			if de == nil || de.IsDead() {
+				continue
+			}
+
+			item := iterItem{
+				key:   make([]byte, de.KeySize()),
+				value: make([]byte, de.ValueSize()),
+			}
+			copy(item.key, de.Key())
+			copy(item.value, de.Value())
+			it.items = append(it.items, item)
+		}
+
+		if node.IsLeftmost() {
+			it.bof = true
+		}
+		if it.bof || len(it.items) > 0 {
+			break
+		}
+
+		// 请求取消时停止遍历
+		if err := it.txn.ctx.Err(); err != nil {
+			it.err = err
+			node.RUnlock()
+			node.Release()
+			return
+		}
+
+		// 左移
+		var err error
+		node, err = it.moveLeft(node)
+		if err != nil {
+			it.err = err
+			return
+		}
+		end = node.GetEndOff()
+	}
+
+	// 收集时为降序，翻转为升序
+	for i, j := 0, len(it.items)-1; i < j; i, j = i+1, j-1 {
+		it.items[i], it.items[j] = it.items[j], it.items[i]
+	}
+	it.pos = len(it.items) - 1
+
+	it.pageId = node.GetPageId()
+	node.RUnlock()
+	node.Release()
+}
+
+// moveLeft 移动到 node 的左兄弟节点
+// 先释放 node 再对左侧节点加锁，避免与从左向右加锁的写操作死锁
+// 左链接可能已经过期，需要从左侧节点右移，直到右链接指向 node
+func (it *Iterator) moveLeft(node *nodes.Node) (*nodes.Node, error) {
+	ing := it.txn.ing
+	pageId, lp := node.GetPageId(), node.GetLeft()
+	node.RUnlock()
+	node.Release()
+
+	ln, err := ing.getNode(lp)
+	if err != nil {
+		return nil, err
+	}
+	ln.RLock()
+
+	for ln.GetRight() != pageId {
+		if ln.IsRightmost() {
+			ln.RUnlock()
+			ln.Release()
+			return nil, errBrokenLeafChain
+		}
+
+		ln, err = ing.moveRight(ln, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ln, nil
+}
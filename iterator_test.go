@@ -0,0 +1,278 @@
+package ingens
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// iterKey 1KB 的 key 让每个叶子节点只能保存几十个 entry
+func iterKey(i int) []byte {
+	return append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{'k'}, MaxKeySize-8)...)
+}
+
+func openIterTest(t *testing.T, n int) *Ingens {
+	opt := DefaultOptions()
+	opt.BufferCapacity = 64
+
+	ing, err := Open(t.TempDir(), opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	err = ing.Exec(func(txn *Txn) error {
+		for i := 0; i < n; i += 2 {
+			if err := txn.Set(iterKey(i), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+	return ing
+}
+
+func TestIterator(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	test := []struct {
+		name string
+
+		opt     IterOptions
+		reverse bool
+		from    []byte // Seek 或 SeekForPrev 的位置
+		want    [2]int // [first, last]，按遍历顺序
+	}{
+		{"forward", IterOptions{}, false, nil, [2]int{0, n - 2}},
+		{"forward seek", IterOptions{}, false, iterKey(101), [2]int{102, n - 2}},
+		{"forward bounded", IterOptions{Lower: iterKey(100), Upper: iterKey(300)}, false, nil, [2]int{100, 298}},
+		{"reverse", IterOptions{}, true, iterKey(n), [2]int{n - 2, 0}},
+		{"reverse seek", IterOptions{}, true, iterKey(101), [2]int{100, 0}},
+		{"reverse bounded", IterOptions{Lower: iterKey(100), Upper: iterKey(300)}, true, iterKey(n), [2]int{298, 100}},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ing.View(func(txn *Txn) error {
+				it := txn.NewIterator(tt.opt)
+				step := 2
+				if tt.reverse {
+					it.SeekForPrev(tt.from)
+					step = -2
+				} else {
+					it.Seek(tt.from)
+				}
+
+				want := tt.want[0]
+				for ; it.Valid(); want += step {
+					if !bytes.Equal(it.Key(), iterKey(want)) || string(it.Value()) != fmt.Sprint(want) {
+						return fmt.Errorf("Key(): got = %.8s, want = %.8s", it.Key(), iterKey(want))
+					}
+					if tt.reverse {
+						it.Prev()
+					} else {
+						it.Next()
+					}
+				}
+				if it.Err() != nil {
+					return it.Err()
+				}
+				if want != tt.want[1]+step {
+					return fmt.Errorf("last key: got = %v, want = %v", want-step, tt.want[1])
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	ing, err := Open(t.TempDir(), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	defer ing.Close(true)
+
+	keys := []string{"a", "b", "b/1", "b/2", "b\xff", "b\xff\xff", "c", "\xff", "\xff\x01"}
+	err = ing.Exec(func(txn *Txn) error {
+		for _, k := range keys {
+			if err := txn.Set([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	test := []struct {
+		prefix string
+		want   []string
+	}{
+		{"b", []string{"b", "b/1", "b/2", "b\xff", "b\xff\xff"}},
+		{"b/", []string{"b/1", "b/2"}},
+		{"b\xff", []string{"b\xff", "b\xff\xff"}},
+		{"\xff", []string{"\xff", "\xff\x01"}},
+		{"d", nil},
+	}
+
+	for _, tt := range test {
+		err := ing.View(func(txn *Txn) error {
+			var got []string
+			for it := txn.ScanPrefix([]byte(tt.prefix)); it.Valid(); it.Next() {
+				got = append(got, string(it.Key()))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				return fmt.Errorf("ScanPrefix(%q): got = %q, want = %q", tt.prefix, got, tt.want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestIteratorConcurrentSplit(t *testing.T) {
+	const n = 400
+
+	test := []struct {
+		name    string
+		reverse bool
+	}{
+		{"forward", false},
+		{"reverse", true},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openIterTest(t, n)
+			defer ing.Close(true)
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			defer txn.Rollback()
+
+			it := txn.NewIterator(IterOptions{})
+			want, step := 0, 2
+			if tt.reverse {
+				it.SeekForPrev(iterKey(n))
+				want, step = n-2, -2
+			} else {
+				it.Seek(nil)
+			}
+
+			// 每一步都在当前 key 附近插入新的 key，拆分迭代器缓存的叶子节点
+			// 新插入的 key 对迭代器的快照不可见
+			for ; it.Valid(); want += step {
+				if !bytes.Equal(it.Key(), iterKey(want)) {
+					t.Fatalf("Key(): got = %.8s, want = %.8s", it.Key(), iterKey(want))
+				}
+				err := ing.Exec(func(w *Txn) error {
+					for _, i := range []int{want - 1, want + 1} {
+						if i < 0 {
+							continue
+						}
+						if err := w.Set(iterKey(i), []byte("new")); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Set() err: %v", err)
+				}
+
+				if tt.reverse {
+					it.Prev()
+				} else {
+					it.Next()
+				}
+			}
+			if it.Err() != nil {
+				t.Fatalf("Err(): %v", it.Err())
+			}
+			if end := map[bool]int{false: n, true: -2}[tt.reverse]; want != end {
+				t.Errorf("last key: got = %v, want = %v", want-step, end-step)
+			}
+		})
+	}
+}
+
+func TestIteratorDirection(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	// 每个叶子节点只能保存几十个 entry，来回移动会跨越叶子节点的边界
+	moves := []int{50, -30, 80, -100, 1, -1, 60}
+
+	err := ing.View(func(txn *Txn) error {
+		it := txn.NewIterator(IterOptions{})
+		it.Seek(iterKey(100))
+		want := 100
+		for _, m := range moves {
+			for ; m != 0; m -= sign(m) {
+				if m > 0 {
+					it.Next()
+					want += 2
+				} else {
+					it.Prev()
+					want -= 2
+				}
+				if !it.Valid() {
+					return fmt.Errorf("Valid(): got = false at %v, err = %v", want, it.Err())
+				}
+				if !bytes.Equal(it.Key(), iterKey(want)) {
+					return fmt.Errorf("Key(): got = %.8s, want = %.8s", it.Key(), iterKey(want))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func sign(i int) int {
+	if i < 0 {
+		return -1
+	}
+	return 1
+}
+
+func TestScanPrefixReverse(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	// iterKey 以 8 位数字开头，前缀 "000001" 覆盖 100 到 199
+	prefix := []byte("000001")
+	err := ing.View(func(txn *Txn) error {
+		it := txn.NewIterator(IterOptions{Lower: prefix, Upper: prefixSuccessor(prefix)})
+		want := 198
+		for it.SeekForPrev(iterKey(n)); it.Valid(); it.Prev() {
+			if !bytes.Equal(it.Key(), iterKey(want)) {
+				return fmt.Errorf("Key(): got = %.8s, want = %.8s", it.Key(), iterKey(want))
+			}
+			want -= 2
+		}
+		if want != 98 {
+			return fmt.Errorf("last key: got = %v, want = 100", want+2)
+		}
+		return it.Err()
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -45,9 +45,9 @@ type (
 		refNum   uint32 // 引用数，赋值操作都在锁住对应的bucket后，原子操作
 		usageNum uint32 // usageNum 时钟扫描需要用到的引用数，原子操作
 
-		isDirty bool // 是否为脏页
-		isValid bool // 页面是否有效
-		isUsed  bool // 该buffer是否被使用过，如果使用过，那么在bufferMap中存在映射
+		isDirty uint32 // 是否为脏页，原子操作
+		isValid bool   // 页面是否有效
+		isUsed  bool   // 该buffer是否被使用过，如果使用过，那么在bufferMap中存在映射
 
 		ioRoutine sync.WaitGroup // 记录io进程
 		data      any
@@ -141,10 +141,11 @@ func (bmgr *BufferManager) GetBufferData(key string, new bool) (any, error) {
 			}
 		} else {
 			// 写出脏页
-			if buf.isDirty {
-				buf.isDirty = false
-				err := bmgr.smgr.Write(buf.data)
+			if atomic.SwapUint32(&buf.isDirty, 0) == 1 {
+				err := bmgr.smgr.Write(buf.key, buf.data)
 				if err != nil {
+					atomic.StoreUint32(&buf.isDirty, 1)
+					atomic.AddUint32(&buf.refNum, ^uint32(0))
 					return nil, err
 				}
 			}
@@ -185,7 +186,9 @@ func (bmgr *BufferManager) GetBufferData(key string, new bool) (any, error) {
 		}
 
 		// 是否有其他线程引用该缓存区
-		if atomic.LoadUint32(&buf.refNum) == 1 {
+		// 写回时未持有 bucket 锁，其他线程可能在写回期间再次修改页面，此时需要重新写回
+		// 引用和 MarkDirty 都需要 bucket 锁，持有锁时这两个值不会再变化
+		if atomic.LoadUint32(&buf.refNum) == 1 && atomic.LoadUint32(&buf.isDirty) == 0 {
 			break
 		}
 
@@ -229,7 +232,7 @@ func (bmgr *BufferManager) GetBufferData(key string, new bool) (any, error) {
 
 	// 如果不为生成新页面，则IO获取
 	if !new {
-		err := bmgr.smgr.Read(buf.data)
+		err := bmgr.smgr.Read(key, buf.data)
 		if err != nil {
 			buf.isValid = false // 获取页面失败
 			atomic.AddUint32(&buf.refNum, ^uint32(0))
@@ -261,7 +264,56 @@ func (bmgr *BufferManager) evict() bufferNumber {
 	}
 }
 
-func (bmgr *BufferManager) Flush() {
+// MarkDirty 标记页面为脏页，淘汰或者 Flush 时写回
+// 调用者需要持有该页面的引用
+func (bmgr *BufferManager) MarkDirty(key string) {
+	b := bmgr.getBucket(key)
+	b.mu.RLock()
+	if bufId, ok := b.items[key]; ok {
+		atomic.StoreUint32(&bmgr.bufferPool[bufId].isDirty, 1)
+	}
+	b.mu.RUnlock()
+}
+
+// ReleaseBufferData 释放 GetBufferData 获取的引用
+func (bmgr *BufferManager) ReleaseBufferData(key string) {
+	b := bmgr.getBucket(key)
+	b.mu.RLock()
+	if bufId, ok := b.items[key]; ok {
+		bmgr.bufferPool[bufId].Release()
+	}
+	b.mu.RUnlock()
+}
+
+// Flush 写回所有脏页
+// 先在 bucket 锁内收集脏页并持有引用，再在锁外写回，写回时 StorageManager 可能需要页面自己的锁
+func (bmgr *BufferManager) Flush() error {
+	var dirty []*Buffer
+	for _, b := range bmgr.bufferMap {
+		b.mu.RLock()
+		for _, bufId := range b.items {
+			buf := bmgr.bufferPool[bufId]
+			if atomic.LoadUint32(&buf.isDirty) == 0 || !buf.isValid {
+				continue
+			}
+
+			// 持有引用，避免写回期间被淘汰
+			atomic.AddUint32(&buf.refNum, 1)
+			dirty = append(dirty, buf)
+		}
+		b.mu.RUnlock()
+	}
+
+	var err error
+	for _, buf := range dirty {
+		if err == nil && atomic.SwapUint32(&buf.isDirty, 0) == 1 {
+			if err = bmgr.smgr.Write(buf.key, buf.data); err != nil {
+				atomic.StoreUint32(&buf.isDirty, 1)
+			}
+		}
+		buf.Release()
+	}
+	return err
 }
 
 // buffer
@@ -1,11 +1,61 @@
 package buffer
 
 import (
-	. "github/suixinpr/ingens/base"
+	"bytes"
 	"strconv"
+	"sync"
 	"testing"
 )
 
+// memPage 缓冲池中的页面
+type memPage struct {
+	key string
+	val []byte
+}
+
+// memStorage 保存在内存中的 StorageManager，记录每个页面的写回次数
+type memStorage struct {
+	mu     sync.Mutex
+	pages  map[string][]byte
+	writes map[string]int
+	hook   func(key string) // 写回完成后调用
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{pages: make(map[string][]byte), writes: make(map[string]int)}
+}
+
+func (s *memStorage) InitData() any {
+	return &memPage{}
+}
+
+func (s *memStorage) Read(key string, data any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := data.(*memPage)
+	p.key = key
+	p.val = append(p.val[:0], s.pages[key]...)
+	return nil
+}
+
+func (s *memStorage) Write(key string, data any) error {
+	s.mu.Lock()
+	s.pages[key] = append([]byte(nil), data.(*memPage).val...)
+	s.writes[key]++
+	s.mu.Unlock()
+
+	if s.hook != nil {
+		s.hook(key)
+	}
+	return nil
+}
+
+func (s *memStorage) page(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pages[key]
+}
+
 func TestNewBufferPool(t *testing.T) {
 	test := []struct {
 		name string
@@ -14,112 +64,211 @@ func TestNewBufferPool(t *testing.T) {
 		bucketNum uint64
 	}{
 		{"DefaultBufferPool", 2048, 256},
+		{"SmallBufferPool", 4, 2},
 	}
 
 	for _, tt := range test {
 		t.Run(tt.name, func(t *testing.T) {
-			bufPool, err := NewBufferPool(tt.capacity, tt.bucketNum)
-			if err != nil {
-				t.Errorf("NewBufferPool() err: %v", err)
+			bmgr := NewBufferPool(tt.capacity, tt.bucketNum, 0, newMemStorage())
+			if len(bmgr.bufferPool) != int(tt.capacity) {
+				t.Errorf("NewBufferPool() capacity: got = %v, want = %v", len(bmgr.bufferPool), int(tt.capacity))
 			}
-			if len(bufPool.buffers) != int(tt.capacity) {
-				t.Errorf("NewBufferPool() capacity: got = %v, want = %v", len(bufPool.buffers), int(tt.capacity))
-			}
-			if len(bufPool.bufferMap) != int(tt.bucketNum) {
-				t.Errorf("NewBufferPool() bucketNum: got = %v, want = %v", len(bufPool.bufferMap), int(tt.bucketNum))
+			if len(bmgr.bufferMap) != int(tt.bucketNum) {
+				t.Errorf("NewBufferPool() bucketNum: got = %v, want = %v", len(bmgr.bufferMap), int(tt.bucketNum))
 			}
 		})
 	}
 }
 
-func TestGetNode(t *testing.T) {
+func TestGetBufferData(t *testing.T) {
 	test := []struct {
 		name string
 
-		pageId PageNumber
+		key string
 	}{
-		{"1", 1},
-		{"2", 2},
-		{"3", 3},
-		{"4", 4},
-		{"5", 5},
-		{"6", 6},
-		{"7", 7},
-		{"8", 8},
+		{"1", "1"},
+		{"2", "2"},
+		{"3", "3"},
+		{"4", "4"},
+		{"5", "5"},
+		{"6", "6"},
+		{"7", "7"},
+		{"8", "8"},
 	}
 
-	bufPool, err := NewBufferPool(4, 2)
-	if err != nil {
-		t.Errorf("TestGetNode() NewBufferPool err: %v", err)
-		return
+	smgr := newMemStorage()
+	for _, tt := range test {
+		smgr.pages[tt.key] = []byte("page " + tt.key)
 	}
+
+	bmgr := NewBufferPool(4, 2, 0, smgr)
 	for _, tt := range test {
 		t.Run(tt.name, func(t *testing.T) {
-			buf, err := bufPool.GetNode(tt.pageId, true, nil)
+			data, err := bmgr.GetBufferData(tt.key, false)
 			if err != nil {
-				t.Errorf("TestGetNode() err: %v", err)
+				t.Fatalf("GetBufferData() err: %v", err)
+			}
+			p := data.(*memPage)
+			if p.key != tt.key || string(p.val) != "page "+tt.key {
+				t.Errorf("GetBufferData() page: got = %v %s, want = %v", p.key, p.val, tt.key)
 			}
-			if buf.pageId != tt.pageId {
-				t.Errorf("TestGetNode() pageId: got = %v, want = %v", buf.pageId, tt.pageId)
+
+			// 持有引用时再次获取同一个页面
+			again, err := bmgr.GetBufferData(tt.key, false)
+			if err != nil {
+				t.Fatalf("GetBufferData() again err: %v", err)
 			}
-			buf.Release()
+			if again != data {
+				t.Errorf("GetBufferData() again: got another buffer")
+			}
+			bmgr.ReleaseBufferData(tt.key)
+			bmgr.ReleaseBufferData(tt.key)
 		})
 	}
 }
 
-func TestParallelGetNode(t *testing.T) {
+func TestParallelGetBufferData(t *testing.T) {
 	processNum := 100
-	test := []struct {
-		name string
+	keys := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
 
-		pageId PageNumber
-	}{
-		{"1", 1},
-		{"2", 2},
-		{"3", 3},
-		{"4", 4},
-		{"5", 5},
-		{"6", 6},
-		{"7", 7},
-		{"8", 8},
-		{"1", 1},
-		{"2", 2},
-		{"3", 3},
-		{"4", 4},
-		{"5", 5},
-		{"6", 6},
-		{"7", 7},
-		{"8", 8},
-		{"1", 1},
-		{"2", 2},
-		{"3", 3},
-		{"4", 4},
-		{"5", 5},
-		{"6", 6},
-		{"7", 7},
-		{"8", 8},
-	}
-
-	bufPool, err := NewBufferPool(4, 4)
-	if err != nil {
-		t.Errorf("TestGetNode() NewBufferPool err: %v", err)
-		return
+	smgr := newMemStorage()
+	for _, key := range keys {
+		smgr.pages[key] = []byte("page " + key)
 	}
+	bmgr := NewBufferPool(4, 4, 0, smgr)
 
 	for i := 0; i < processNum; i++ {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			t.Parallel()
-			for _, tt := range test {
-				ep := EmptryPage(tt.pageId, 0)
-				n, err := bufPool.GetNode(tt.pageId, true, nil)
+			for _, key := range keys {
+				data, err := bmgr.GetBufferData(key, false)
 				if err != nil {
-					t.Errorf("TestGetNode() err: %v", err)
+					t.Errorf("GetBufferData() err: %v", err)
+					continue
 				}
-				if buf.pageId != tt.pageId {
-					t.Errorf("TestGetNode() pageId: got = %v, want = %v", buf.pageId, tt.pageId)
+				if p := data.(*memPage); p.key != key {
+					t.Errorf("GetBufferData() key: got = %v, want = %v", p.key, key)
 				}
-				buf.Release()
+				bmgr.ReleaseBufferData(key)
 			}
 		})
 	}
 }
+
+func TestEvictDirty(t *testing.T) {
+	test := []struct {
+		name string
+
+		dirty  bool
+		writes int
+	}{
+		{"clean", false, 0},
+		{"dirty", true, 1},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			smgr := newMemStorage()
+			bmgr := NewBufferPool(1, 1, 0, smgr)
+
+			data, err := bmgr.GetBufferData("1", true)
+			if err != nil {
+				t.Fatalf("GetBufferData() err: %v", err)
+			}
+			data.(*memPage).val = []byte("modified")
+			if tt.dirty {
+				bmgr.MarkDirty("1")
+			}
+			bmgr.ReleaseBufferData("1")
+
+			// 只有一个 buffer，获取其他页面时淘汰页面 1
+			if _, err := bmgr.GetBufferData("2", true); err != nil {
+				t.Fatalf("GetBufferData() evict err: %v", err)
+			}
+			bmgr.ReleaseBufferData("2")
+
+			if smgr.writes["1"] != tt.writes {
+				t.Errorf("writes: got = %v, want = %v", smgr.writes["1"], tt.writes)
+			}
+			if tt.dirty && !bytes.Equal(smgr.page("1"), []byte("modified")) {
+				t.Errorf("page: got = %s, want = modified", smgr.page("1"))
+			}
+
+			// 写回后再次读取
+			data, err = bmgr.GetBufferData("1", false)
+			if err != nil {
+				t.Fatalf("GetBufferData() reread err: %v", err)
+			}
+			if got := data.(*memPage).val; tt.dirty != bytes.Equal(got, []byte("modified")) {
+				t.Errorf("reread page: got = %s", got)
+			}
+			bmgr.ReleaseBufferData("1")
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	smgr := newMemStorage()
+	bmgr := NewBufferPool(4, 2, 0, smgr)
+
+	for _, key := range []string{"1", "2", "3"} {
+		data, err := bmgr.GetBufferData(key, true)
+		if err != nil {
+			t.Fatalf("GetBufferData() err: %v", err)
+		}
+		data.(*memPage).val = []byte("page " + key)
+		if key != "2" {
+			bmgr.MarkDirty(key)
+		}
+		bmgr.ReleaseBufferData(key)
+	}
+
+	if err := bmgr.Flush(); err != nil {
+		t.Fatalf("Flush() err: %v", err)
+	}
+	if err := bmgr.Flush(); err != nil {
+		t.Fatalf("Flush() again err: %v", err)
+	}
+	for key, want := range map[string]int{"1": 1, "2": 0, "3": 1} {
+		if smgr.writes[key] != want {
+			t.Errorf("writes %v: got = %v, want = %v", key, smgr.writes[key], want)
+		}
+	}
+}
+
+func TestEvictRedirtied(t *testing.T) {
+	smgr := newMemStorage()
+	bmgr := NewBufferPool(1, 1, 0, smgr)
+
+	data, err := bmgr.GetBufferData("1", true)
+	if err != nil {
+		t.Fatalf("GetBufferData() err: %v", err)
+	}
+	data.(*memPage).val = []byte("first")
+	bmgr.MarkDirty("1")
+	bmgr.ReleaseBufferData("1")
+
+	// 第一次写回之后、淘汰之前，其他线程引用页面 1 并再次修改
+	smgr.hook = func(key string) {
+		if key != "1" || smgr.writes["1"] != 1 {
+			return
+		}
+		data, err := bmgr.GetBufferData("1", false)
+		if err != nil {
+			t.Errorf("GetBufferData() in write err: %v", err)
+			return
+		}
+		data.(*memPage).val = []byte("second")
+		bmgr.MarkDirty("1")
+		bmgr.ReleaseBufferData("1")
+	}
+
+	if _, err := bmgr.GetBufferData("2", true); err != nil {
+		t.Fatalf("GetBufferData() evict err: %v", err)
+	}
+	bmgr.ReleaseBufferData("2")
+
+	if got := smgr.page("1"); !bytes.Equal(got, []byte("second")) {
+		t.Errorf("page: got = %s, want = second", got)
+	}
+}
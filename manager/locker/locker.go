@@ -1,12 +1,19 @@
 package locker
 
 import (
+	"context"
+	"errors"
 	"hash/fnv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrLockTimeout the lock is not acquired within the timeout
+	ErrLockTimeout = errors.New("lock timeout")
+)
+
 type (
 	// schedule
 	LockerManager struct {
@@ -54,6 +61,24 @@ func (s *LockerManager) getBucket(key []byte) *bucket {
 }
 
 func (s *LockerManager) Lock(key []byte) bool {
+	return s.LockTimeout(key, s.timeout)
+}
+
+// LockTimeout 等待 timeout 后仍未获得锁时返回 false，timeout 为 0 时使用默认超时时间
+func (s *LockerManager) LockTimeout(key []byte, timeout time.Duration) bool {
+	return s.LockContext(context.Background(), key, timeout) == nil
+}
+
+// LockContext 等待 timeout 后仍未获得锁时返回 ErrLockTimeout，ctx 结束时返回 ctx.Err()
+// timeout 为 0 时使用默认超时时间
+func (s *LockerManager) LockContext(ctx context.Context, key []byte, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if timeout == 0 {
+		timeout = s.timeout
+	}
+
 	b := s.getBucket(key)
 	k := string(key)
 
@@ -80,11 +105,18 @@ func (s *LockerManager) Lock(key []byte) bool {
 		}
 	}
 
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
 	case res.locked <- struct{}{}:
-		return true
-	case <-time.After(s.timeout):
-		return false
+		return nil
+	case <-timer.C:
+		atomic.AddUint32(&res.acquireNum, ^uint32(0))
+		return ErrLockTimeout
+	case <-ctx.Done():
+		atomic.AddUint32(&res.acquireNum, ^uint32(0))
+		return ctx.Err()
 	}
 }
 
@@ -1,6 +1,8 @@
 package locker
 
 import (
+	"context"
+	"errors"
 	"strconv"
 	"testing"
 	"time"
@@ -75,3 +77,39 @@ func TestParallelLockAndUnlock(t *testing.T) {
 		}
 	})
 }
+
+func TestLockContext(t *testing.T) {
+	test := []struct {
+		name string
+
+		timeout time.Duration
+		cancel  time.Duration
+		want    error
+	}{
+		{"timeout", 10 * time.Millisecond, time.Second, ErrLockTimeout},
+		{"cancel", time.Second, 10 * time.Millisecond, context.Canceled},
+	}
+
+	rm := NewLockerManager(4, time.Second)
+	key := []byte("key")
+	if ok := rm.Lock(key); !ok {
+		t.Fatalf("Lock() err: %v", ok)
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			time.AfterFunc(tt.cancel, cancel)
+
+			if err := rm.LockContext(ctx, key, tt.timeout); !errors.Is(err, tt.want) {
+				t.Errorf("LockContext() err: got = %v, want = %v", err, tt.want)
+			}
+		})
+	}
+
+	rm.Unlock(key)
+	if n := rm.Clean(); n != 1 {
+		t.Errorf("Clean() num: got = %v, want = %v", n, 1)
+	}
+}
@@ -0,0 +1,370 @@
+package locker
+
+import (
+	"bytes"
+	"github/suixinpr/ingens/base"
+	"sync"
+)
+
+// SIReadManager tracks the read dependencies of serializable transactions
+// and detects dangerous structures of rw-antidependencies.
+//
+// A rw-antidependency R -> W exists when R reads a version of a key and a
+// concurrent W writes a newer version of it. R records what it has read with
+// SIREAD markers on keys and scanned ranges, so that a later write by W can
+// find R. If R finds a version it cannot see, the writer is already known.
+//
+// A transaction with both an incoming and an outgoing rw-antidependency is a
+// pivot, and a pivot can make the schedule non-serializable. A pivot that is
+// still running fails at commit, unless all its running neighbours on one
+// side have a lower priority, in which case they are doomed instead. When the
+// pivot has already committed, the other running participant is doomed.
+// Edges of an aborted transaction are removed, and doomed neighbours are
+// ignored, so that no transaction is aborted for nothing.
+type (
+	SIReadManager struct {
+		mu sync.Mutex
+
+		keys    map[string][]*SerializableTxn           // key -> 读过该 key 的事务
+		ranges  [rangeBuckets][]*rangeMarker            // key 的第一个字节 -> 包含该字节开头的 key 的范围
+		writers map[base.TransactionId]*SerializableTxn // tid -> 写入过数据的事务
+
+		active    map[*SerializableTxn]struct{}
+		committed []*SerializableTxn // 已提交，但仍可能与活跃事务并发
+	}
+
+	SerializableTxn struct {
+		tid         base.TransactionId
+		snapshotCsn base.CommitSequenceNumber
+		commitCsn   base.CommitSequenceNumber
+		priority    int
+
+		inConflicts  map[*SerializableTxn]struct{} // other -> txn
+		outConflicts map[*SerializableTxn]struct{} // txn -> other
+		prepared     bool                          // 已经通过提交检查，不能再回滚
+		doomed       bool                          // 提交时必须回滚
+
+		keys   map[string]struct{} // 同一个 key 只记录一次
+		ranges []*rangeMarker
+	}
+
+	// rangeMarker [lower, upper)，nil 表示没有边界
+	// 保存在 [first, last] 的每个桶中
+	rangeMarker struct {
+		lower []byte
+		upper []byte
+		first int
+		last  int
+		txn   *SerializableTxn
+	}
+)
+
+// rangeBuckets 范围标记按 key 的第一个字节分桶，写入时只检查一个桶
+const rangeBuckets = 256
+
+func NewSIReadManager() *SIReadManager {
+	return &SIReadManager{
+		keys:    make(map[string][]*SerializableTxn),
+		writers: make(map[base.TransactionId]*SerializableTxn),
+		active:  make(map[*SerializableTxn]struct{}),
+	}
+}
+
+// Register 可串行化事务开始，冲突时优先回滚 priority 较低的事务
+func (m *SIReadManager) Register(snapshotCsn base.CommitSequenceNumber, priority int) *SerializableTxn {
+	sx := &SerializableTxn{
+		snapshotCsn:  snapshotCsn,
+		priority:     priority,
+		inConflicts:  make(map[*SerializableTxn]struct{}),
+		outConflicts: make(map[*SerializableTxn]struct{}),
+		keys:         make(map[string]struct{}),
+	}
+
+	m.mu.Lock()
+	m.active[sx] = struct{}{}
+	m.mu.Unlock()
+	return sx
+}
+
+// SetTid 事务第一次写入时记录 tid，读者通过 tid 找到写入新版本的事务
+func (m *SIReadManager) SetTid(sx *SerializableTxn, tid base.TransactionId) {
+	m.mu.Lock()
+	sx.tid = tid
+	m.writers[tid] = sx
+	m.mu.Unlock()
+}
+
+// ReadKey 记录 sx 读取了 key，重复读取同一个 key 不再记录
+func (m *SIReadManager) ReadKey(sx *SerializableTxn, key []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := sx.keys[string(key)]; ok {
+		return
+	}
+	k := string(key)
+	m.keys[k] = append(m.keys[k], sx)
+	sx.keys[k] = struct{}{}
+}
+
+// ReadRange 记录 sx 扫描了 [lower, upper)
+func (m *SIReadManager) ReadRange(sx *SerializableTxn, lower, upper []byte) {
+	r := &rangeMarker{lower: cloneBound(lower), upper: cloneBound(upper), txn: sx}
+
+	// upper 的第一个字节开头的 key 仍然可能小于 upper
+	r.first, r.last = 0, rangeBuckets-1
+	if len(lower) > 0 {
+		r.first = int(lower[0])
+	}
+	if upper != nil {
+		r.last = rangeBucket(upper)
+	}
+
+	m.mu.Lock()
+	for b := r.first; b <= r.last; b++ {
+		m.ranges[b] = append(m.ranges[b], r)
+	}
+	sx.ranges = append(sx.ranges, r)
+	m.mu.Unlock()
+}
+
+// ReadConflict sx 读到了一个不可见的新版本，新版本由 tid 写入
+func (m *SIReadManager) ReadConflict(sx *SerializableTxn, tid base.TransactionId) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if w, ok := m.writers[tid]; ok && w != sx {
+		m.addConflict(sx, w)
+	}
+}
+
+// Write 记录 sx 写入了 key，所有读过 key 的并发事务都与 sx 构成读写反依赖
+func (m *SIReadManager) Write(sx *SerializableTxn, key []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.keys[string(key)] {
+		if r != sx && m.isConcurrent(r, sx) {
+			m.addConflict(r, sx)
+		}
+	}
+
+	for _, rm := range m.ranges[rangeBucket(key)] {
+		if rm.txn != sx && rm.contains(key) && m.isConcurrent(rm.txn, sx) {
+			m.addConflict(rm.txn, sx)
+		}
+	}
+}
+
+// PreCommit 提交前检查，返回 false 时事务必须回滚
+func (m *SIReadManager) PreCommit(sx *SerializableTxn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sx.doomed {
+		return false
+	}
+
+	// 回滚优先级较低的邻居，使 sx 不再是 pivot
+	if sx.isPivot() && !m.resolve(sx) {
+		return false
+	}
+
+	sx.prepared = true
+	return true
+}
+
+// Commit 事务已经提交
+// 已提交事务的标记保留到所有与之并发的事务结束
+func (m *SIReadManager) Commit(sx *SerializableTxn, csn base.CommitSequenceNumber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sx.commitCsn = csn
+	delete(m.active, sx)
+	m.committed = append(m.committed, sx)
+	m.clean()
+}
+
+// Abort 事务已经回滚，删除它的所有标记
+func (m *SIReadManager) Abort(sx *SerializableTxn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.active, sx)
+	m.release(sx)
+	m.clean()
+}
+
+// isConcurrent r 在 w 获取快照之前没有提交
+func (m *SIReadManager) isConcurrent(r, w *SerializableTxn) bool {
+	return r.commitCsn == base.InvalidCsn || r.commitCsn > w.snapshotCsn
+}
+
+// addConflict 添加 r -> w 的读写反依赖
+// 已提交或者已通过提交检查的 pivot 无法回滚，改为回滚另一个仍在运行的事务
+func (m *SIReadManager) addConflict(r, w *SerializableTxn) {
+	r.outConflicts[w] = struct{}{}
+	w.inConflicts[r] = struct{}{}
+
+	if w.isPivot() && w.prepared && !r.prepared {
+		r.doomed = true
+	}
+	if r.isPivot() && r.prepared && !w.prepared {
+		w.doomed = true
+	}
+}
+
+// resolve 选择入边或出边一侧，该侧仍在运行的邻居优先级都低于 sx 时回滚它们
+// 优先选择需要回滚的事务较少的一侧
+func (m *SIReadManager) resolve(sx *SerializableTxn) bool {
+	in, inOk := sx.victims(sx.inConflicts)
+	out, outOk := sx.victims(sx.outConflicts)
+
+	var victims []*SerializableTxn
+	switch {
+	case inOk && (!outOk || len(in) <= len(out)):
+		victims = in
+	case outOk:
+		victims = out
+	default:
+		return false
+	}
+
+	for _, v := range victims {
+		v.doomed = true
+	}
+	return true
+}
+
+// clean 删除不再与任何活跃事务并发的已提交事务
+func (m *SIReadManager) clean() {
+	oldest := base.CommitSequenceNumber(^uint64(0))
+	for sx := range m.active {
+		if sx.snapshotCsn < oldest {
+			oldest = sx.snapshotCsn
+		}
+	}
+
+	n := 0
+	for _, sx := range m.committed {
+		if sx.commitCsn <= oldest {
+			m.release(sx)
+			continue
+		}
+		m.committed[n] = sx
+		n++
+	}
+	for i := n; i < len(m.committed); i++ {
+		m.committed[i] = nil
+	}
+	m.committed = m.committed[:n]
+}
+
+// release 删除 sx 的标记
+func (m *SIReadManager) release(sx *SerializableTxn) {
+	for k := range sx.keys {
+		readers := m.keys[k]
+		n := 0
+		for _, r := range readers {
+			if r != sx {
+				readers[n] = r
+				n++
+			}
+		}
+		if n == 0 {
+			delete(m.keys, k)
+		} else {
+			m.keys[k] = readers[:n]
+		}
+	}
+
+	for _, r := range sx.ranges {
+		for b := r.first; b <= r.last; b++ {
+			m.ranges[b] = removeRange(m.ranges[b], r)
+		}
+	}
+
+	if sx.tid != base.InvalidTid {
+		delete(m.writers, sx.tid)
+	}
+	sx.keys, sx.ranges = nil, nil
+
+	// 删除与 sx 相关的读写反依赖
+	for o := range sx.outConflicts {
+		delete(o.inConflicts, sx)
+	}
+	for i := range sx.inConflicts {
+		delete(i.outConflicts, sx)
+	}
+}
+
+// isPivot 同时存在入边和出边，已注定回滚的邻居不计算在内
+func (sx *SerializableTxn) isPivot() bool {
+	return hasLive(sx.inConflicts) && hasLive(sx.outConflicts)
+}
+
+// victims 返回 conflicts 中需要回滚的邻居，存在无法回滚的邻居时返回 false
+func (sx *SerializableTxn) victims(conflicts map[*SerializableTxn]struct{}) ([]*SerializableTxn, bool) {
+	var victims []*SerializableTxn
+	for o := range conflicts {
+		if o.doomed {
+			continue
+		}
+		if o.prepared || o.priority >= sx.priority {
+			return nil, false
+		}
+		victims = append(victims, o)
+	}
+	return victims, true
+}
+
+func hasLive(conflicts map[*SerializableTxn]struct{}) bool {
+	for o := range conflicts {
+		if !o.doomed {
+			return true
+		}
+	}
+	return false
+}
+
+func (rm *rangeMarker) contains(key []byte) bool {
+	if rm.lower != nil && bytes.Compare(key, rm.lower) < 0 {
+		return false
+	}
+	if rm.upper != nil && bytes.Compare(key, rm.upper) >= 0 {
+		return false
+	}
+	return true
+}
+
+// rangeBucket key 所在的桶
+func rangeBucket(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+	return int(key[0])
+}
+
+// removeRange 从桶中删除 r
+func removeRange(bucket []*rangeMarker, r *rangeMarker) []*rangeMarker {
+	n := 0
+	for _, rm := range bucket {
+		if rm != r {
+			bucket[n] = rm
+			n++
+		}
+	}
+	for i := n; i < len(bucket); i++ {
+		bucket[i] = nil
+	}
+	return bucket[:n]
+}
+
+// cloneBound 复制范围边界，nil 表示没有边界
+func cloneBound(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
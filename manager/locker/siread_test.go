@@ -0,0 +1,170 @@
+package locker
+
+import (
+	"github/suixinpr/ingens/base"
+	"testing"
+)
+
+func TestWriteSkew(t *testing.T) {
+	m := NewSIReadManager()
+
+	// t1, t2 从同一快照开始，各自读取 x, y 并写入对方读过的 key
+	t1 := m.Register(1, 0)
+	t2 := m.Register(1, 0)
+	m.ReadKey(t1, []byte("x"))
+	m.ReadKey(t1, []byte("y"))
+	m.ReadKey(t2, []byte("x"))
+	m.ReadKey(t2, []byte("y"))
+
+	m.SetTid(t1, 1)
+	m.Write(t1, []byte("x"))
+	m.SetTid(t2, 2)
+	m.Write(t2, []byte("y"))
+
+	// 先提交的 t1 是 pivot，提交失败
+	if ok := m.PreCommit(t1); ok {
+		t.Errorf("PreCommit() t1: got = %v, want = %v", ok, false)
+	}
+	m.Abort(t1)
+
+	if ok := m.PreCommit(t2); !ok {
+		t.Errorf("PreCommit() t2: got = %v, want = %v", ok, true)
+	}
+	m.Commit(t2, 2)
+
+	if len(m.keys) != 0 || len(m.writers) != 0 || len(m.committed) != 0 {
+		t.Errorf("Commit() markers: got = %v, %v, %v, want empty", len(m.keys), len(m.writers), len(m.committed))
+	}
+}
+
+func TestDoomAfterPivotCommit(t *testing.T) {
+	m := NewSIReadManager()
+
+	// pivot 只有出边时提交成功，之后出现的入边使读者提交失败
+	pivot := m.Register(1, 0)
+	reader := m.Register(1, 0)
+	writer := m.Register(1, 0)
+
+	m.ReadKey(pivot, []byte("a"))
+	m.SetTid(writer, 3)
+	m.Write(writer, []byte("a"))
+	if ok := m.PreCommit(writer); !ok {
+		t.Fatalf("PreCommit() writer: got = %v, want = %v", ok, true)
+	}
+	m.Commit(writer, 2)
+
+	m.SetTid(pivot, 4)
+	m.Write(pivot, []byte("b"))
+	if ok := m.PreCommit(pivot); !ok {
+		t.Fatalf("PreCommit() pivot: got = %v, want = %v", ok, true)
+	}
+	m.Commit(pivot, 3)
+
+	// reader 读到 pivot 写入的不可见版本
+	m.ReadConflict(reader, base.TransactionId(4))
+	if ok := m.PreCommit(reader); ok {
+		t.Errorf("PreCommit() reader: got = %v, want = %v", ok, false)
+	}
+	m.Abort(reader)
+}
+
+func TestRangeMarker(t *testing.T) {
+	test := []struct {
+		name string
+
+		lower, upper []byte
+		key          []byte
+		want         bool
+	}{
+		{"inside", []byte("a"), []byte("c"), []byte("b"), true},
+		{"upper bound", []byte("a"), []byte("c"), []byte("c"), false},
+		{"upper bucket", []byte("a"), []byte("cc"), []byte("cb"), true},
+		{"below lower", []byte("b"), []byte("c"), []byte("a"), false},
+		{"no lower", nil, []byte("c"), []byte{0}, true},
+		{"no upper", []byte("a"), nil, []byte{0xff, 0xff}, true},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewSIReadManager()
+
+			reader := m.Register(1, 0)
+			writer := m.Register(1, 0)
+			m.ReadRange(reader, tt.lower, tt.upper)
+
+			m.SetTid(writer, 1)
+			m.Write(writer, tt.key)
+			if _, ok := reader.outConflicts[writer]; ok != tt.want {
+				t.Errorf("Write() conflict: got = %v, want = %v", ok, tt.want)
+			}
+
+			// 回滚后所有桶中都不再有 reader 的范围
+			m.Abort(reader)
+			for b, bucket := range m.ranges {
+				if len(bucket) != 0 {
+					t.Errorf("Abort() bucket %d: got = %v, want = 0", b, len(bucket))
+				}
+			}
+		})
+	}
+}
+
+func TestReadKeyOnce(t *testing.T) {
+	m := NewSIReadManager()
+
+	sx := m.Register(1, 0)
+	for i := 0; i < 3; i++ {
+		m.ReadKey(sx, []byte("x"))
+	}
+	if n := len(m.keys["x"]); n != 1 {
+		t.Errorf("ReadKey() markers: got = %v, want = %v", n, 1)
+	}
+
+	m.Abort(sx)
+	if n := len(m.keys); n != 0 {
+		t.Errorf("Abort() markers: got = %v, want = %v", n, 0)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	test := []struct {
+		name string
+
+		low, high     int
+		lowOk, highOk bool
+	}{
+		{"same priority", 0, 0, true, false},
+		{"high priority", 0, 1, false, true},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewSIReadManager()
+
+			// 写偏斜，high 先提交
+			low := m.Register(1, tt.low)
+			high := m.Register(1, tt.high)
+			m.ReadKey(low, []byte("x"))
+			m.ReadKey(low, []byte("y"))
+			m.ReadKey(high, []byte("x"))
+			m.ReadKey(high, []byte("y"))
+
+			m.SetTid(low, 1)
+			m.Write(low, []byte("x"))
+			m.SetTid(high, 2)
+			m.Write(high, []byte("y"))
+
+			if ok := m.PreCommit(high); ok != tt.highOk {
+				t.Errorf("PreCommit() high: got = %v, want = %v", ok, tt.highOk)
+			} else if ok {
+				m.Commit(high, 2)
+			} else {
+				m.Abort(high)
+			}
+
+			if ok := m.PreCommit(low); ok != tt.lowOk {
+				t.Errorf("PreCommit() low: got = %v, want = %v", ok, tt.lowOk)
+			}
+		})
+	}
+}
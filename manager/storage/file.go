@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"github/suixinpr/ingens/base"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Open 打开 path 目录下的文件 name，目录和文件不存在时创建
+func Open(path, name string) (*os.File, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(path, name), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// Read 读取 pageId 处 size 大小的页面
+func Read(file *os.File, pageId base.PageNumber, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := file.ReadAt(buf, int64(pageId)*int64(base.PageSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// 读取数据长度不对
+	if n != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// Write 将 buf 写入 pageId 处
+func Write(file *os.File, pageId base.PageNumber, buf []byte) error {
+	n, err := file.WriteAt(buf, int64(pageId)*int64(base.PageSize))
+	if err != nil {
+		return err
+	}
+
+	// 写入数据长度不对
+	if n != len(buf) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
@@ -4,10 +4,12 @@ import (
 	"hash/fnv"
 )
 
+// StorageManager reads and writes the page of key into data,
+// data is allocated by InitData and cached by the buffer manager
 type StorageManager interface {
 	InitData() any
-	Read(any) error
-	Write(any) error
+	Read(key string, data any) error
+	Write(key string, data any) error
 }
 
 func Sum64(buf []byte) uint64 {
@@ -0,0 +1,384 @@
+package transaction
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/buffer"
+	"github/suixinpr/ingens/manager/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// errClogChecksum the checksum of a commit log page is wrong
+	errClogChecksum = errors.New("commit log page checksum error")
+)
+
+var (
+	// 每个页面保存的 csn 数量，页面最后 8 字节为校验和
+	clogPerPage = uint64(base.PageDataUpper) / 8
+
+	// 每个段保存的 csn 数量
+	clogPerSegment = clogPerPage * clogPagesPerSegment
+)
+
+const (
+	// 每个段文件的页面数量，截断时整段删除
+	clogPagesPerSegment = 32
+
+	// commit log 缓存的页面数量
+	clogBufferCapacity  = 64
+	clogBufferBucketNum = 16
+)
+
+type (
+	// CommitLog 持久化 tid -> csn，文件按段划分，页面通过 BufferManager 按需加载
+	// 段文件 ingens.clog.0000 保存 tid 在 [0, clogPerSegment) 内的事务
+	CommitLog struct {
+		path string
+		bmgr *buffer.BufferManager
+		smgr *clogStorage
+
+		mu        sync.RWMutex
+		truncated base.TransactionId // 小于该 tid 的段已经删除
+	}
+
+	clogStorage struct {
+		path string
+
+		mu    sync.Mutex
+		files map[uint64]*os.File // segment -> file
+	}
+
+	clogPage struct {
+		mu   sync.RWMutex
+		data []byte
+	}
+)
+
+// OpenCommitLog 打开 path 目录下的 commit log
+func OpenCommitLog(path string) (*CommitLog, error) {
+	smgr := &clogStorage{path: path, files: make(map[uint64]*os.File)}
+	clog := &CommitLog{
+		path: path,
+		bmgr: buffer.NewBufferPool(clogBufferCapacity, clogBufferBucketNum, base.PageSize, smgr),
+		smgr: smgr,
+	}
+
+	// 最小的段文件之前的段已经被截断
+	segs, err := clog.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		clog.truncated = base.TransactionId(segs[0] * clogPerSegment)
+	}
+	return clog, nil
+}
+
+// Load 返回 tid 的 csn，截断之前的事务都已经结束，返回 FrozenCsn
+// 回滚的事务在截断之前已经撤销了所有修改，不会再被读取
+func (clog *CommitLog) Load(tid base.TransactionId) (base.CommitSequenceNumber, error) {
+	clog.mu.RLock()
+	defer clog.mu.RUnlock()
+
+	if tid < clog.truncated {
+		return base.FrozenCsn, nil
+	}
+
+	key := clogPageKey(tid)
+	page, err := clog.getPage(key)
+	if err != nil {
+		return base.InvalidCsn, err
+	}
+	defer clog.bmgr.ReleaseBufferData(key)
+
+	page.mu.RLock()
+	csn := base.CommitSequenceNumber(binary.BigEndian.Uint64(page.data[clogOffset(tid):]))
+	page.mu.RUnlock()
+	return csn, nil
+}
+
+// Store 记录 tid 的 csn，页面在 Flush 或者淘汰时写回
+func (clog *CommitLog) Store(tid base.TransactionId, csn base.CommitSequenceNumber) error {
+	clog.mu.RLock()
+	defer clog.mu.RUnlock()
+
+	key := clogPageKey(tid)
+	page, err := clog.getPage(key)
+	if err != nil {
+		return err
+	}
+	defer clog.bmgr.ReleaseBufferData(key)
+
+	page.mu.Lock()
+	binary.BigEndian.PutUint64(page.data[clogOffset(tid):], uint64(csn))
+	page.mu.Unlock()
+
+	clog.bmgr.MarkDirty(key)
+	return nil
+}
+
+// Truncated 返回截断的位置，小于该 tid 的事务都已经结束
+func (clog *CommitLog) Truncated() base.TransactionId {
+	clog.mu.RLock()
+	defer clog.mu.RUnlock()
+	return clog.truncated
+}
+
+// Flush 写回所有修改过的页面
+func (clog *CommitLog) Flush() error {
+	if err := clog.bmgr.Flush(); err != nil {
+		return err
+	}
+	return clog.smgr.sync()
+}
+
+// Truncate 删除所有 tid 都小于 oldest 的段，oldest 是仍可能被 DataEntry 引用的最小 tid
+func (clog *CommitLog) Truncate(oldest base.TransactionId) error {
+	clog.mu.Lock()
+	defer clog.mu.Unlock()
+
+	segs, err := clog.segments()
+	if err != nil {
+		return err
+	}
+
+	// 先写回缓存的页面，避免淘汰时重新创建已删除的段
+	if err := clog.bmgr.Flush(); err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		if base.TransactionId((seg+1)*clogPerSegment) > oldest {
+			break
+		}
+		if err := clog.smgr.remove(seg); err != nil {
+			return err
+		}
+		clog.truncated = base.TransactionId((seg + 1) * clogPerSegment)
+	}
+	return nil
+}
+
+// Latest 扫描最后一个段，返回其中最大的 tid 和 csn，用于恢复 latestTid 和 latestCsn
+func (clog *CommitLog) Latest() (base.TransactionId, base.CommitSequenceNumber, error) {
+	segs, err := clog.segments()
+	if err != nil || len(segs) == 0 {
+		return base.InvalidTid, base.InvalidCsn, err
+	}
+
+	var maxTid base.TransactionId
+	var maxCsn base.CommitSequenceNumber
+	first := segs[len(segs)-1] * clogPagesPerSegment
+	for pageno := first; pageno < first+clogPagesPerSegment; pageno++ {
+		key := strconv.FormatUint(pageno, 10)
+		page, err := clog.getPage(key)
+		if err != nil {
+			return base.InvalidTid, base.InvalidCsn, err
+		}
+
+		page.mu.RLock()
+		for i := uint64(0); i < clogPerPage; i++ {
+			csn := base.CommitSequenceNumber(binary.BigEndian.Uint64(page.data[i*8:]))
+			if csn == base.InvalidCsn {
+				continue
+			}
+
+			maxTid = base.TransactionId(pageno*clogPerPage + i)
+			if csn != base.AbortedCsn && csn > maxCsn {
+				maxCsn = csn
+			}
+		}
+		page.mu.RUnlock()
+		clog.bmgr.ReleaseBufferData(key)
+	}
+	return maxTid, maxCsn, nil
+}
+
+// Close 写回所有页面并关闭段文件
+func (clog *CommitLog) Close() error {
+	if err := clog.Flush(); err != nil {
+		return err
+	}
+	return clog.smgr.close()
+}
+
+func (clog *CommitLog) getPage(key string) (*clogPage, error) {
+	data, err := clog.bmgr.GetBufferData(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return data.(*clogPage), nil
+}
+
+// segments 返回按顺序排列的段号
+func (clog *CommitLog) segments() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(clog.path, "ingens.clog.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]uint64, 0, len(matches))
+	for _, m := range matches {
+		seg, err := strconv.ParseUint(filepath.Ext(m)[1:], 16, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+func clogPageKey(tid base.TransactionId) string {
+	return strconv.FormatUint(uint64(tid)/clogPerPage, 10)
+}
+
+func clogOffset(tid base.TransactionId) uint64 {
+	return uint64(tid) % clogPerPage * 8
+}
+
+// storage
+
+func (smgr *clogStorage) InitData() any {
+	return &clogPage{data: make([]byte, base.PageSize)}
+}
+
+// Read 读取页面，段文件中不存在的页面全部为 InvalidCsn
+func (smgr *clogStorage) Read(key string, data any) error {
+	page := data.(*clogPage)
+	pageno, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	f, err := smgr.file(pageno / clogPagesPerSegment)
+	if err != nil {
+		return err
+	}
+
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	off := int64(pageno%clogPagesPerSegment) * int64(base.PageSize)
+	n, err := f.ReadAt(page.data, off)
+	if err == io.EOF {
+		for i := n; i < len(page.data); i++ {
+			page.data[i] = 0
+		}
+		if n == 0 {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// 校验和，文件空洞中的页面全部为 0
+	sum := binary.BigEndian.Uint64(page.data[base.PageDataUpper:])
+	if sum != storage.Sum64(page.data[:base.PageDataUpper]) && !isZero(page.data) {
+		return errClogChecksum
+	}
+	return nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (smgr *clogStorage) Write(key string, data any) error {
+	page := data.(*clogPage)
+	pageno, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	f, err := smgr.file(pageno / clogPagesPerSegment)
+	if err != nil {
+		return err
+	}
+
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	binary.BigEndian.PutUint64(page.data[base.PageDataUpper:], storage.Sum64(page.data[:base.PageDataUpper]))
+	off := int64(pageno%clogPagesPerSegment) * int64(base.PageSize)
+	n, err := f.WriteAt(page.data, off)
+	if err != nil {
+		return err
+	}
+	if n != base.PageSize {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// file 返回段文件，不存在时创建
+func (smgr *clogStorage) file(seg uint64) (*os.File, error) {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	if f, ok := smgr.files[seg]; ok {
+		return f, nil
+	}
+
+	name := filepath.Join(smgr.path, fmt.Sprintf("ingens.clog.%04X", seg))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	smgr.files[seg] = f
+	return f, nil
+}
+
+func (smgr *clogStorage) remove(seg uint64) error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	if f, ok := smgr.files[seg]; ok {
+		f.Close()
+		delete(smgr.files, seg)
+	}
+
+	name := filepath.Join(smgr.path, fmt.Sprintf("ingens.clog.%04X", seg))
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (smgr *clogStorage) sync() error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	for _, f := range smgr.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (smgr *clogStorage) close() error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	for seg, f := range smgr.files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		delete(smgr.files, seg)
+	}
+	return nil
+}
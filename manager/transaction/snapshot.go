@@ -0,0 +1,81 @@
+package transaction
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type (
+	// snapshotRegistry 正在使用的快照
+	// 按 csn 组成最小堆用于计算 OldestActiveCsn，按获取时间组成链表用于统计最长的快照
+	snapshotRegistry struct {
+		mu         sync.Mutex
+		heap       snapshotHeap
+		head, tail *Snapshot
+	}
+
+	snapshotHeap []*Snapshot
+)
+
+func (r *snapshotRegistry) add(snapshot *Snapshot) {
+	snapshot.start = time.Now()
+	heap.Push(&r.heap, snapshot)
+
+	// 链表尾部
+	snapshot.prev, snapshot.next = r.tail, nil
+	if r.tail != nil {
+		r.tail.next = snapshot
+	} else {
+		r.head = snapshot
+	}
+	r.tail = snapshot
+}
+
+func (r *snapshotRegistry) remove(snapshot *Snapshot) {
+	heap.Remove(&r.heap, snapshot.index)
+
+	if snapshot.prev != nil {
+		snapshot.prev.next = snapshot.next
+	} else {
+		r.head = snapshot.next
+	}
+	if snapshot.next != nil {
+		snapshot.next.prev = snapshot.prev
+	} else {
+		r.tail = snapshot.prev
+	}
+	snapshot.prev, snapshot.next = nil, nil
+}
+
+// heap.Interface
+
+func (h snapshotHeap) Len() int {
+	return len(h)
+}
+
+func (h snapshotHeap) Less(i, j int) bool {
+	return h[i].csn < h[j].csn
+}
+
+func (h snapshotHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *snapshotHeap) Push(x any) {
+	snapshot := x.(*Snapshot)
+	snapshot.index = len(*h)
+	*h = append(*h, snapshot)
+}
+
+func (h *snapshotHeap) Pop() any {
+	old := *h
+	n := len(old)
+	snapshot := old[n-1]
+	old[n-1] = nil
+	snapshot.index = -1
+	*h = old[:n-1]
+	return snapshot
+}
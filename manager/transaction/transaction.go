@@ -2,8 +2,16 @@ package transaction
 
 import (
 	"github/suixinpr/ingens/base"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	// commitResolution 提交时间的精度，同一时间段内的提交只记录最后一个
+	// 保留的记录不超过 VersionRetention / commitResolution 个
+	commitResolution = time.Millisecond
 )
 
 type (
@@ -13,59 +21,459 @@ type (
 		latestTid    base.TransactionId
 		latestCsn    base.CommitSequenceNumber
 		snapshotPool sync.Pool
+		snapshots    snapshotRegistry // 正在使用的快照
+
+		// 保留期限内的提交时间，用于读取历史快照
+		mu        sync.Mutex
+		retention time.Duration
+		commits   []commitRecord
+		horizon   commitRecord // 最后一个超出保留期限的提交
+
+		// 不大于 purged 的事务都已经结束并写入 commit log，提交的事务对所有快照可见，只由回收线程推进
+		purged base.TransactionId
+	}
+
+	commitRecord struct {
+		csn  base.CommitSequenceNumber
+		time time.Time
 	}
 
 	Snapshot struct {
 		tid base.TransactionId
 		csn base.CommitSequenceNumber
+
+		// registry
+		start      time.Time
+		index      int // 在堆中的位置
+		prev, next *Snapshot
 	}
 
+	// tableTidToCsn 缓存本次启动之后的事务状态，同时写入 commit log
+	// 重启之前结束的事务和已经回收的事务从 commit log 读取
 	tableTidToCsn struct {
-		new   func() []base.CommitSequenceNumber
-		slice sync.Map
+		new   func() *tidSlice
+		slice sync.Map // tid >> 16 -> *tidSlice
+
+		clog     *CommitLog
+		restored base.TransactionId // 不大于该 tid 的事务在重启之前分配
+		dropped  uint64             // 不大于该 tid 的 slice 已经删除，原子操作
+
+		mu  sync.Mutex
+		err error // 写入 commit log 失败，Flush 时返回
+	}
+
+	tidSlice struct {
+		csn     []base.CommitSequenceNumber
+		pending int64 // 还没有写入 commit log 的数量，原子操作
 	}
 )
 
-func NewTransactionManager() *TransactionManager {
-	return nil
+func NewTransactionManager(retention time.Duration, clog *CommitLog) *TransactionManager {
+	tmgr := &TransactionManager{
+		latestCsn: base.FrozenCsn,
+		retention: retention,
+		tidStatus: &tableTidToCsn{
+			new: func() *tidSlice {
+				return &tidSlice{csn: make([]base.CommitSequenceNumber, 1<<16)}
+			},
+			clog: clog,
+		},
+	}
+	tmgr.snapshotPool = sync.Pool{
+		New: func() any {
+			return new(Snapshot)
+		},
+	}
+	return tmgr
 }
 
 func (tmgr *TransactionManager) GetSnapshot() *Snapshot {
 	snapshot := tmgr.snapshotPool.Get().(*Snapshot)
-	snapshot.tid = base.TransactionId(atomic.LoadUint64((*uint64)(&tmgr.latestTid)))
-	snapshot.csn = base.CommitSequenceNumber(atomic.LoadUint64((*uint64)(&tmgr.latestCsn)))
 
-	// tid 可能比 csn 的版本早，但是没有关系
-	// 以 csn 为准，tid 只是减少查看对过老事务提交序列号的查询
+	// 读取 csn 和登记快照之间，OldestActiveCsn 不能越过该快照
+	tmgr.snapshots.mu.Lock()
+	defer tmgr.snapshots.mu.Unlock()
+
+	// 先读取 csn 再读取 tid
+	// 大于 snapshot.tid 的事务在读取 csn 之后才分配 tid，提交序列号一定大于 snapshot.csn
+	snapshot.csn = base.CommitSequenceNumber(atomic.LoadUint64((*uint64)(&tmgr.latestCsn)))
+	snapshot.tid = base.TransactionId(atomic.LoadUint64((*uint64)(&tmgr.latestTid)))
+	tmgr.snapshots.add(snapshot)
 	return snapshot
 }
 
+// GetSnapshotAt 返回 csn 提交之后的历史快照
+// csn 超出保留期限或者尚未分配时返回 false
+func (tmgr *TransactionManager) GetSnapshotAt(csn base.CommitSequenceNumber) (*Snapshot, bool) {
+	// 检查和登记之间，PurgeHorizon 不能越过该快照
+	tmgr.snapshots.mu.Lock()
+	defer tmgr.snapshots.mu.Unlock()
+
+	tmgr.mu.Lock()
+	ok := csn >= tmgr.horizon.csn && csn <= tmgr.LatestCsn()
+	tmgr.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// csn 之后提交的事务 csn 更大，不需要限制 tid
+	snapshot := tmgr.snapshotPool.Get().(*Snapshot)
+	snapshot.csn = csn
+	snapshot.tid = base.TransactionId(atomic.LoadUint64((*uint64)(&tmgr.latestTid)))
+	tmgr.snapshots.add(snapshot)
+	return snapshot, true
+}
+
+// CsnAsOf 返回 t 时刻最后一个提交的 csn，t 超出保留期限时返回 false
+func (tmgr *TransactionManager) CsnAsOf(t time.Time) (base.CommitSequenceNumber, bool) {
+	tmgr.mu.Lock()
+	defer tmgr.mu.Unlock()
+
+	i := sort.Search(len(tmgr.commits), func(i int) bool {
+		return tmgr.commits[i].time.After(t)
+	})
+	if i > 0 {
+		return tmgr.commits[i-1].csn, true
+	}
+
+	// 早于所有保留的提交，没有提交超出过保留期限时为空数据库
+	if tmgr.horizon.csn <= base.FrozenCsn || !t.Before(tmgr.horizon.time) {
+		return tmgr.horizon.csn, true
+	}
+	return base.InvalidCsn, false
+}
+
+// Recover 重启后恢复 latestTid 和 latestCsn，取 meta 与 commit log 中较大的值
+// 之前的提交时间已经丢失，历史快照只能从 latestCsn 开始
+// 重启之前没有写入 commit log 的事务随重启中断，回滚之前回收不能越过它们
+func (tmgr *TransactionManager) Recover(tid base.TransactionId, csn base.CommitSequenceNumber) error {
+	clogTid, clogCsn, err := tmgr.tidStatus.clog.Latest()
+	if err != nil {
+		return err
+	}
+	if clogTid > tid {
+		tid = clogTid
+	}
+	if clogCsn > csn {
+		csn = clogCsn
+	}
+	if csn < base.FrozenCsn {
+		csn = base.FrozenCsn
+	}
+
+	atomic.StoreUint64((*uint64)(&tmgr.latestTid), uint64(tid))
+	atomic.StoreUint64((*uint64)(&tmgr.latestCsn), uint64(csn))
+	tmgr.tidStatus.restored = tid
+	if truncated := tmgr.tidStatus.clog.Truncated(); truncated > base.InvalidTid {
+		tmgr.purged = truncated - 1
+	}
+
+	tmgr.mu.Lock()
+	tmgr.horizon = commitRecord{csn: csn, time: time.Now()}
+	tmgr.mu.Unlock()
+	return nil
+}
+
+// Unfinished 返回重启时中断的事务，它们在 commit log 中没有记录
+// 调用者回滚它们之后调用 AbortTransaction，在此之前回收不会越过它们
+func (tmgr *TransactionManager) Unfinished() ([]base.TransactionId, error) {
+	var tids []base.TransactionId
+	for tid := tmgr.purged + 1; tid <= tmgr.tidStatus.restored; tid++ {
+		csn, err := tmgr.tidStatus.clog.Load(tid)
+		if err != nil {
+			return nil, err
+		}
+		if csn == base.InvalidCsn {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// Flush 写回 commit log
+func (tmgr *TransactionManager) Flush() error {
+	table := tmgr.tidStatus
+	table.mu.Lock()
+	err := table.err
+	table.err = nil
+	table.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return table.clog.Flush()
+}
+
+// TruncateCommitLog 删除 oldest 之前的 commit log，oldest 是仍可能被引用的最小 tid
+func (tmgr *TransactionManager) TruncateCommitLog(oldest base.TransactionId) error {
+	return tmgr.tidStatus.clog.Truncate(oldest)
+}
+
+// Close 写回并关闭 commit log
+func (tmgr *TransactionManager) Close() error {
+	if err := tmgr.Flush(); err != nil {
+		return err
+	}
+	return tmgr.tidStatus.clog.Close()
+}
+
+// LatestTid 最近一次分配的 tid
+func (tmgr *TransactionManager) LatestTid() base.TransactionId {
+	return base.TransactionId(atomic.LoadUint64((*uint64)(&tmgr.latestTid)))
+}
+
+// LatestCsn 最近一次分配的提交序列号
+func (tmgr *TransactionManager) LatestCsn() base.CommitSequenceNumber {
+	return base.CommitSequenceNumber(atomic.LoadUint64((*uint64)(&tmgr.latestCsn)))
+}
+
 func (tmgr *TransactionManager) GetTransactionId() base.TransactionId {
 	return base.TransactionId(atomic.AddUint64((*uint64)(&tmgr.latestTid), 1))
 }
 
+// CheckVisibility 判断 tid 的修改对快照是否可见
+// 只有在快照之前提交的事务可见，未提交和已回滚的事务都不可见
 func (tmgr *TransactionManager) CheckVisibility(tid base.TransactionId, snapshot *Snapshot) bool {
-	if tid < snapshot.tid {
+	// 没有事务信息的 entry 对所有快照可见
+	if tid == base.InvalidTid {
 		return true
 	}
 
+	// 快照之后才开始写入的事务
+	if tid > snapshot.tid {
+		return false
+	}
+
 	csn := tmgr.tidStatus.load(tid)
-	return csn < snapshot.csn
+	return csn != base.InvalidCsn && csn != base.AbortedCsn && csn <= snapshot.csn
 }
 
-func (tmgr *TransactionManager) FinishTransaction(tid base.TransactionId, snapshot *Snapshot) {
-	tmgr.tidStatus.store(tid, atomic.AddUint64((*uint64)(&tmgr.latestCsn), 1))
+// IsCommitted 判断 tid 是否已经提交，不考虑快照
+func (tmgr *TransactionManager) IsCommitted(tid base.TransactionId) bool {
+	if tid == base.InvalidTid {
+		return true
+	}
+
+	csn := tmgr.tidStatus.load(tid)
+	return csn != base.InvalidCsn && csn != base.AbortedCsn
+}
+
+// FinishTransaction 为事务分配提交序列号，此后获取的快照都可以看到该事务的修改
+func (tmgr *TransactionManager) FinishTransaction(tid base.TransactionId, snapshot *Snapshot) base.CommitSequenceNumber {
+	// 先写入事务状态再推进 latestCsn，与 GetSnapshot 互斥
+	// 读到新 csn 的快照一定能看到该事务已经提交，提交时间按 csn 顺序记录
+	tmgr.snapshots.mu.Lock()
+	tmgr.mu.Lock()
+	csn := tmgr.LatestCsn() + 1
+	tmgr.tidStatus.set(tid, csn)
+	atomic.StoreUint64((*uint64)(&tmgr.latestCsn), uint64(csn))
+	tmgr.recordCommit(csn, time.Now())
+	tmgr.mu.Unlock()
+	tmgr.snapshots.mu.Unlock()
+
+	// commit log 的 io 不需要持有锁
+	tmgr.tidStatus.persist(tid, csn)
+	tmgr.ReleaseSnapshot(snapshot)
+	return csn
+}
+
+// recordCommit 记录提交时间，并移除超出保留期限的提交
+func (tmgr *TransactionManager) recordCommit(csn base.CommitSequenceNumber, now time.Time) {
+	tmgr.commits = append(tmgr.commits, commitRecord{csn: csn, time: now})
+
+	n := 0
+	for n < len(tmgr.commits) && now.Sub(tmgr.commits[n].time) > tmgr.retention {
+		n++
+	}
+	if n > 0 {
+		tmgr.horizon = tmgr.commits[n-1]
+		tmgr.commits = tmgr.commits[n:]
+	}
+
+	// 与上一个记录在同一时间段内时只保留新的记录，CsnAsOf 在该时间段内可能返回更早的提交
+	if n := len(tmgr.commits); n > 1 && tmgr.commits[n-2].time.Truncate(commitResolution).Equal(now.Truncate(commitResolution)) {
+		tmgr.commits[n-2] = tmgr.commits[n-1]
+		tmgr.commits = tmgr.commits[:n-1]
+	}
+}
+
+// AbortTransaction 标记事务已回滚，其修改对任何快照都不可见
+// 没有快照的事务，例如重启时中断的事务，snapshot 为 nil
+func (tmgr *TransactionManager) AbortTransaction(tid base.TransactionId, snapshot *Snapshot) {
+	tmgr.tidStatus.store(tid, base.AbortedCsn)
+	if snapshot != nil {
+		tmgr.ReleaseSnapshot(snapshot)
+	}
+}
+
+// ReleaseSnapshot 归还快照，没有分配 tid 的事务结束时调用
+func (tmgr *TransactionManager) ReleaseSnapshot(snapshot *Snapshot) {
+	tmgr.snapshots.mu.Lock()
+	tmgr.snapshots.remove(snapshot)
+	tmgr.snapshots.mu.Unlock()
+
 	tmgr.snapshotPool.Put(snapshot)
 }
 
-func (table *tableTidToCsn) store(tid base.TransactionId, csn uint64) {
-	v, _ := table.slice.LoadOrStore(tid>>16, table.new)
-	t := v.([]base.CommitSequenceNumber)
-	atomic.StoreUint64((*uint64)(&t[tid&0xffff]), csn)
+// OldestActiveCsn 返回正在使用的快照中最小的 csn，没有快照时返回 latestCsn
+// 提交序列号不大于该值的事务覆盖的旧版本不会再被读取
+func (tmgr *TransactionManager) OldestActiveCsn() base.CommitSequenceNumber {
+	tmgr.snapshots.mu.Lock()
+	defer tmgr.snapshots.mu.Unlock()
+
+	if len(tmgr.snapshots.heap) == 0 {
+		return tmgr.LatestCsn()
+	}
+	return tmgr.snapshots.heap[0].csn
+}
+
+// PurgeHorizon 返回回收的边界
+// csn 为所有快照和保留期限内的历史快照都能看到的提交序列号，小于 tid 的事务都已经结束，
+// 提交的事务 csn 不大于该值，它们覆盖的旧版本和删除的 entry 不会再被读取
+func (tmgr *TransactionManager) PurgeHorizon() (base.TransactionId, base.CommitSequenceNumber) {
+	tmgr.snapshots.mu.Lock()
+	csn := tmgr.LatestCsn()
+	if len(tmgr.snapshots.heap) > 0 {
+		csn = tmgr.snapshots.heap[0].csn
+	}
+	tmgr.mu.Lock()
+	if tmgr.horizon.csn < csn {
+		csn = tmgr.horizon.csn
+	}
+	tmgr.mu.Unlock()
+	tmgr.snapshots.mu.Unlock()
+
+	// 按 tid 顺序推进，遇到未结束或者提交较晚的事务停止
+	latest := tmgr.LatestTid()
+	for tmgr.purged < latest {
+		c, ok := tmgr.tidStatus.finished(tmgr.purged + 1)
+		if !ok || c != base.AbortedCsn && c > csn {
+			break
+		}
+		tmgr.purged++
+	}
+	tmgr.tidStatus.drop(tmgr.purged)
+	return tmgr.purged + 1, csn
+}
+
+// ActiveSnapshots 返回正在使用的快照数量和其中最早获取的时间
+func (tmgr *TransactionManager) ActiveSnapshots() (int, time.Time) {
+	tmgr.snapshots.mu.Lock()
+	defer tmgr.snapshots.mu.Unlock()
+
+	if tmgr.snapshots.head == nil {
+		return 0, time.Time{}
+	}
+	return len(tmgr.snapshots.heap), tmgr.snapshots.head.start
+}
+
+func (snapshot *Snapshot) Tid() base.TransactionId {
+	return snapshot.tid
+}
+
+func (snapshot *Snapshot) Csn() base.CommitSequenceNumber {
+	return snapshot.csn
+}
+
+func (table *tableTidToCsn) store(tid base.TransactionId, csn base.CommitSequenceNumber) {
+	table.set(tid, csn)
+	table.persist(tid, csn)
+}
+
+// set 只修改内存中的事务状态，之后需要调用 persist
+func (table *tableTidToCsn) set(tid base.TransactionId, csn base.CommitSequenceNumber) {
+	t := table.getSlice(tid)
+	atomic.AddInt64(&t.pending, 1)
+	atomic.StoreUint64((*uint64)(&t.csn[tid&0xffff]), uint64(csn))
+}
+
+// persist 将事务状态写入 commit log，失败时在 Flush 返回，该 slice 不会被删除
+func (table *tableTidToCsn) persist(tid base.TransactionId, csn base.CommitSequenceNumber) {
+	if err := table.clog.Store(tid, csn); err != nil {
+		table.mu.Lock()
+		table.err = err
+		table.mu.Unlock()
+		return
+	}
+	atomic.AddInt64(&table.getSlice(tid).pending, -1)
 }
 
 func (table *tableTidToCsn) load(tid base.TransactionId) base.CommitSequenceNumber {
-	v, _ := table.slice.LoadOrStore(tid>>16, table.new)
-	t := v.([]base.CommitSequenceNumber)
-	return base.CommitSequenceNumber(atomic.LoadUint64((*uint64)(&t[tid&0xffff])))
+	if csn, ok := table.memory(tid); ok {
+		return csn
+	}
+
+	csn, err := table.clog.Load(tid)
+	if err != nil {
+		table.mu.Lock()
+		table.err = err
+		table.mu.Unlock()
+		return base.InvalidCsn
+	}
+
+	// 重启之前的事务，没有提交记录时已经随重启中断，视为回滚
+	if csn == base.InvalidCsn && tid <= table.restored {
+		return base.AbortedCsn
+	}
+	return csn
+}
+
+// finished 返回 tid 是否已经结束，重启之前的事务需要在 commit log 中有记录
+// 与 load 不同，重启时中断的事务在回滚之前不视为结束
+func (table *tableTidToCsn) finished(tid base.TransactionId) (base.CommitSequenceNumber, bool) {
+	if csn, ok := table.memory(tid); ok {
+		return csn, csn != base.InvalidCsn
+	}
+
+	csn, err := table.clog.Load(tid)
+	if err != nil {
+		table.mu.Lock()
+		table.err = err
+		table.mu.Unlock()
+		return base.InvalidCsn, false
+	}
+	return csn, csn != base.InvalidCsn
+}
+
+// memory 从内存中读取 tid 的状态，重启之前分配或者已经删除的 tid 返回 false，需要读取 commit log
+func (table *tableTidToCsn) memory(tid base.TransactionId) (base.CommitSequenceNumber, bool) {
+	if tid <= table.restored {
+		return base.InvalidCsn, false
+	}
+	if v, ok := table.slice.Load(tid >> 16); ok {
+		t := v.(*tidSlice)
+		return base.CommitSequenceNumber(atomic.LoadUint64((*uint64)(&t.csn[tid&0xffff]))), true
+	}
+
+	// 不大于 dropped 的 slice 已经删除，否则 slice 还没有创建，其中的事务都没有结束
+	if uint64(tid) > atomic.LoadUint64(&table.dropped) {
+		return base.InvalidCsn, true
+	}
+	return base.InvalidCsn, false
+}
+
+// drop 删除所有 tid 都不大于 purged 的 slice，它们已经写入 commit log
+func (table *tableTidToCsn) drop(purged base.TransactionId) {
+	upper := (purged + 1) >> 16
+	table.slice.Range(func(k, v any) bool {
+		seg := k.(base.TransactionId)
+		if seg >= upper || atomic.LoadInt64(&v.(*tidSlice).pending) > 0 {
+			return true
+		}
+
+		// 先推进 dropped 再删除，memory 找不到 slice 时从 commit log 读取
+		if last := uint64(seg+1)<<16 - 1; last > atomic.LoadUint64(&table.dropped) {
+			atomic.StoreUint64(&table.dropped, last)
+		}
+		table.slice.Delete(k)
+		return true
+	})
+}
+
+// 每个 slice 保存 64K 个事务的提交序列号
+func (table *tableTidToCsn) getSlice(tid base.TransactionId) *tidSlice {
+	if v, ok := table.slice.Load(tid >> 16); ok {
+		return v.(*tidSlice)
+	}
+	v, _ := table.slice.LoadOrStore(tid>>16, table.new())
+	return v.(*tidSlice)
 }
@@ -0,0 +1,238 @@
+package transaction
+
+import (
+	"github/suixinpr/ingens/base"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, path string, retention time.Duration) *TransactionManager {
+	clog, err := OpenCommitLog(path)
+	if err != nil {
+		t.Fatalf("OpenCommitLog() err: %v", err)
+	}
+	tmgr := NewTransactionManager(retention, clog)
+	if err := tmgr.Recover(base.InvalidTid, base.InvalidCsn); err != nil {
+		t.Fatalf("Recover() err: %v", err)
+	}
+	return tmgr
+}
+
+func TestSnapshotRegistry(t *testing.T) {
+	test := []struct {
+		name    string
+		release []int // 按顺序归还的快照
+	}{
+		{"in order", []int{0, 1, 2, 3}},
+		{"reverse", []int{3, 2, 1, 0}},
+		{"middle first", []int{1, 2, 0, 3}},
+		{"oldest last", []int{2, 3, 1, 0}},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			tmgr := newTestManager(t, t.TempDir(), time.Hour)
+			defer tmgr.Close()
+
+			// 每个快照之间提交一个事务，快照的 csn 依次增大
+			var snapshots []*Snapshot
+			for i := 0; i < len(tt.release); i++ {
+				snapshots = append(snapshots, tmgr.GetSnapshot())
+				w := tmgr.GetSnapshot()
+				tmgr.FinishTransaction(tmgr.GetTransactionId(), w)
+			}
+
+			released := make([]bool, len(snapshots))
+			for _, i := range tt.release {
+				tmgr.ReleaseSnapshot(snapshots[i])
+				released[i] = true
+
+				// 剩余快照中最早获取的快照 csn 最小
+				oldest := -1
+				for j := range snapshots {
+					if !released[j] {
+						oldest = j
+						break
+					}
+				}
+
+				n, _ := tmgr.ActiveSnapshots()
+				if oldest < 0 {
+					if n != 0 {
+						t.Errorf("ActiveSnapshots() after %d: got = %v, want = 0", i, n)
+					}
+					if got := tmgr.OldestActiveCsn(); got != tmgr.LatestCsn() {
+						t.Errorf("OldestActiveCsn() after %d: got = %v, want = %v", i, got, tmgr.LatestCsn())
+					}
+					continue
+				}
+
+				if got, want := tmgr.OldestActiveCsn(), snapshots[oldest].Csn(); got != want {
+					t.Errorf("OldestActiveCsn() after %d: got = %v, want = %v", i, got, want)
+				}
+				if tmgr.snapshots.head != snapshots[oldest] {
+					t.Errorf("registry head after %d: got = %p, want = %p", i, tmgr.snapshots.head, snapshots[oldest])
+				}
+			}
+		})
+	}
+}
+
+func TestCommitLog(t *testing.T) {
+	path := t.TempDir()
+	clog, err := OpenCommitLog(path)
+	if err != nil {
+		t.Fatalf("OpenCommitLog() err: %v", err)
+	}
+
+	// 段边界两侧的事务
+	boundary := base.TransactionId(clogPerSegment)
+	test := []struct {
+		tid base.TransactionId
+		csn base.CommitSequenceNumber
+	}{
+		{1, 2},
+		{boundary - 1, 3},
+		{boundary, base.AbortedCsn},
+		{boundary + 1, 4},
+		{2*boundary + 7, 5},
+	}
+	for _, tt := range test {
+		if err := clog.Store(tt.tid, tt.csn); err != nil {
+			t.Fatalf("Store(%v) err: %v", tt.tid, err)
+		}
+	}
+	if err := clog.Close(); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+
+	clog, err = OpenCommitLog(path)
+	if err != nil {
+		t.Fatalf("OpenCommitLog() again err: %v", err)
+	}
+	for _, tt := range test {
+		if got, err := clog.Load(tt.tid); err != nil || got != tt.csn {
+			t.Errorf("Load(%v): got = %v, %v, want = %v", tt.tid, got, err, tt.csn)
+		}
+	}
+	if got, err := clog.Load(boundary + 2); err != nil || got != base.InvalidCsn {
+		t.Errorf("Load(%v): got = %v, %v, want = %v", boundary+2, got, err, base.InvalidCsn)
+	}
+
+	tid, csn, err := clog.Latest()
+	if err != nil || tid != 2*boundary+7 || csn != 5 {
+		t.Errorf("Latest(): got = %v, %v, %v, want = %v, %v", tid, csn, err, 2*boundary+7, 5)
+	}
+
+	// 只删除所有 tid 都小于 oldest 的段
+	if err := clog.Truncate(boundary + 1); err != nil {
+		t.Fatalf("Truncate() err: %v", err)
+	}
+	if err := clog.Close(); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+
+	clog, err = OpenCommitLog(path)
+	if err != nil {
+		t.Fatalf("OpenCommitLog() after truncate err: %v", err)
+	}
+	defer clog.Close()
+
+	if got := clog.Truncated(); got != boundary {
+		t.Errorf("Truncated(): got = %v, want = %v", got, boundary)
+	}
+	for _, tt := range test {
+		want := tt.csn
+		if tt.tid < boundary {
+			want = base.FrozenCsn
+		}
+		if got, err := clog.Load(tt.tid); err != nil || got != want {
+			t.Errorf("Load(%v) after truncate: got = %v, %v, want = %v", tt.tid, got, err, want)
+		}
+	}
+}
+
+func TestDropTidStatus(t *testing.T) {
+	// 不保留历史版本，提交的事务可以立即回收
+	tmgr := newTestManager(t, t.TempDir(), 0)
+	defer tmgr.Close()
+
+	// 超过一个 slice 的事务，奇数 tid 回滚
+	n := base.TransactionId(1<<16 + 10)
+	for i := base.TransactionId(1); i <= n; i++ {
+		tid := tmgr.GetTransactionId()
+		snapshot := tmgr.GetSnapshot()
+		if tid%2 == 1 {
+			tmgr.AbortTransaction(tid, snapshot)
+		} else {
+			tmgr.FinishTransaction(tid, snapshot)
+		}
+	}
+
+	if oldest, _ := tmgr.PurgeHorizon(); oldest <= 1<<16 {
+		t.Fatalf("PurgeHorizon(): got = %v, want > %v", oldest, 1<<16)
+	}
+	if _, ok := tmgr.tidStatus.slice.Load(base.TransactionId(0)); ok {
+		t.Errorf("slice 0 is not dropped")
+	}
+	if _, ok := tmgr.tidStatus.slice.Load(base.TransactionId(1)); !ok {
+		t.Errorf("slice 1 is dropped")
+	}
+
+	// 删除的 slice 从 commit log 读取
+	for _, tid := range []base.TransactionId{1, 2, 1<<16 - 1, 1<<16 - 2, 1 << 16, n} {
+		if got, want := tmgr.IsCommitted(tid), tid%2 == 0; got != want {
+			t.Errorf("IsCommitted(%v): got = %v, want = %v", tid, got, want)
+		}
+	}
+}
+
+func TestRecordCommit(t *testing.T) {
+	tmgr := newTestManager(t, t.TempDir(), time.Hour)
+	defer tmgr.Close()
+
+	// 同一毫秒内的提交只保留最后一个
+	start := time.Now().Truncate(commitResolution)
+	commits := []struct {
+		csn base.CommitSequenceNumber
+		at  time.Duration
+	}{
+		{2, 100 * time.Microsecond},
+		{3, 500 * time.Microsecond},
+		{4, 1200 * time.Microsecond},
+		{5, 1900 * time.Microsecond},
+		{6, 5 * time.Millisecond},
+	}
+	for _, c := range commits {
+		tmgr.recordCommit(c.csn, start.Add(c.at))
+	}
+	for i := 0; i < 10000; i++ {
+		tmgr.recordCommit(base.CommitSequenceNumber(7+i), start.Add(8*time.Millisecond))
+	}
+	if len(tmgr.commits) != 4 {
+		t.Errorf("commits: got = %v, want = 4", len(tmgr.commits))
+	}
+
+	test := []struct {
+		at  time.Duration
+		csn base.CommitSequenceNumber
+	}{
+		{600 * time.Microsecond, 3},
+		{1500 * time.Microsecond, 3}, // 与 csn 5 在同一毫秒内，返回之前的提交
+		{2 * time.Millisecond, 5},
+		{6 * time.Millisecond, 6},
+		{time.Second, 10006},
+	}
+	for _, tt := range test {
+		if csn, ok := tmgr.CsnAsOf(start.Add(tt.at)); !ok || csn != tt.csn {
+			t.Errorf("CsnAsOf(%v): got = %v, %v, want = %v", tt.at, csn, ok, tt.csn)
+		}
+	}
+
+	// 超出保留期限的记录移除，最后一个成为 horizon
+	tmgr.retention = time.Millisecond
+	tmgr.recordCommit(10007, start.Add(20*time.Millisecond))
+	if len(tmgr.commits) != 1 || tmgr.horizon.csn != 10006 {
+		t.Errorf("commits: got = %v, horizon = %v, want = 1, 10006", len(tmgr.commits), tmgr.horizon.csn)
+	}
+}
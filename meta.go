@@ -1,9 +1,11 @@
 package ingens
 
 import (
+	"encoding/binary"
 	"errors"
 	"github/suixinpr/ingens/base"
-	"github/suixinpr/ingens/storage"
+	"github/suixinpr/ingens/manager/storage"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -11,6 +13,8 @@ var (
 	errChecksum = errors.New("checksum error")
 
 	errMagic = errors.New("magic error")
+
+	errVersion = errors.New("version error")
 )
 
 const (
@@ -18,9 +22,18 @@ const (
 	magic uint64 = 0xF1434F740C53863D
 
 	// version
-	version uint64 = 010
+	// 011 在 meta 最后增加 csn，010 的 meta 没有 csn，每一层最左侧节点从 csn 的位置开始
+	version    uint64 = 011
+	version010 uint64 = 010
+
+	metaSize    = unsafe.Sizeof(meta{})
+	metaSize010 = unsafe.Offsetof(meta{}.csn)
+
+	// 每一层最左侧节点的 pageId 保存在 meta 之后
+	levelSize = 32
 
-	metaSize = unsafe.Sizeof(meta{})
+	// 每次在 meta 中预留的 tid 数量
+	tidBatch = 1024
 )
 
 type meta struct {
@@ -31,6 +44,7 @@ type meta struct {
 	root    base.PageNumber
 	pageNum base.PageNumber
 	level   []base.PageNumber
+	csn     base.CommitSequenceNumber
 }
 
 func (ing *Ingens) initMeta() error {
@@ -39,14 +53,83 @@ func (ing *Ingens) initMeta() error {
 		return err
 	}
 
+	sum := binary.BigEndian.Uint64(buf[base.PageDataUpper:])
+	if sum != storage.Sum64(buf[:base.PageDataUpper]) {
+		return errChecksum
+	}
+
 	m := (*meta)(unsafe.Pointer(&buf[0]))
 	if magic != m.magic {
-		return nil
+		return errMagic
 	}
 	if version < m.version {
-		return nil
+		return errVersion
+	}
+
+	// 升级 010，在原来每一层最左侧节点的位置写入 csn，meta 在下一次写回时持久化
+	if m.version == version010 {
+		n := uintptr(levelSize) * unsafe.Sizeof(base.PageNumber(0))
+		copy(buf[metaSize:metaSize+n], buf[metaSize010:metaSize010+n])
+		m.csn = base.InvalidCsn
+		m.version = version
 	}
 
 	ing.meta = m
 	return nil
 }
+
+// metaLevels meta 页面中保存每一层最左侧节点的位置
+func (ing *Ingens) metaLevels() []base.PageNumber {
+	return unsafe.Slice((*base.PageNumber)(unsafe.Add(unsafe.Pointer(ing.meta), metaSize)), levelSize)
+}
+
+// writeMeta 将根节点、页面数量、每一层最左侧节点和 csn 写回 meta 页面
+// 调用前需要先写回 commit log 和 btree 的页面，meta 不能指向还没有写回的根节点
+func (ing *Ingens) writeMeta() error {
+	ing.metaMu.Lock()
+	defer ing.metaMu.Unlock()
+
+	ing.meta.root = base.PageNumber(atomic.LoadUint64((*uint64)(&ing.root)))
+	ing.meta.pageNum = base.PageNumber(atomic.LoadUint64((*uint64)(&ing.pageNum)))
+	ing.meta.csn = ing.tmgr.LatestCsn()
+	copy(ing.metaLevels(), ing.levels)
+	return ing.writeMetaPage()
+}
+
+// getTransactionId 分配 tid，meta 中的 tid 始终不小于已经分配的 tid
+// 重启后从 meta 中的 tid 之后分配，崩溃之前写入页面的 tid 不会被重复使用
+func (ing *Ingens) getTransactionId() (base.TransactionId, error) {
+	tid := ing.tmgr.GetTransactionId()
+	if tid <= base.TransactionId(atomic.LoadUint64((*uint64)(&ing.meta.tid))) {
+		return tid, nil
+	}
+
+	ing.metaMu.Lock()
+	defer ing.metaMu.Unlock()
+
+	if tid <= ing.meta.tid {
+		return tid, nil
+	}
+
+	// 只修改 tid，其余字段仍然是上次写回的内容
+	old := ing.meta.tid
+	atomic.StoreUint64((*uint64)(&ing.meta.tid), uint64(tid+tidBatch))
+	err := ing.writeMetaPage()
+	if err == nil {
+		err = ing.file.Sync()
+	}
+	if err != nil {
+		// 该 tid 不会被使用，标记为回滚，回收可以越过它
+		atomic.StoreUint64((*uint64)(&ing.meta.tid), uint64(old))
+		ing.tmgr.AbortTransaction(tid, nil)
+		return base.InvalidTid, err
+	}
+	return tid, nil
+}
+
+// writeMetaPage 计算校验和并写回 meta 页面，调用者持有 metaMu
+func (ing *Ingens) writeMetaPage() error {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(ing.meta)), base.PageSize)
+	binary.BigEndian.PutUint64(buf[base.PageDataUpper:], storage.Sum64(buf[:base.PageDataUpper]))
+	return storage.Write(ing.file, 0, buf)
+}
@@ -0,0 +1,91 @@
+package ingens
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func TestMetaVersion010(t *testing.T) {
+	path := t.TempDir()
+	opt := DefaultOptions()
+	opt.BufferCapacity = 64
+
+	key := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{'k'}, MaxKeySize-8)...)
+	}
+
+	ing, err := Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	err = ing.Exec(func(txn *Txn) error {
+		for i := 0; i < 500; i++ {
+			if err := txn.Set(key(i), key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+	if err := ing.Close(true); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+
+	// 改写为 010 的布局，每一层最左侧节点紧跟在 level 之后，没有 csn
+	file, err := os.OpenFile(filepath.Join(path, "ingens.data"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() err: %v", err)
+	}
+	buf, err := storage.Read(file, 0, base.PageSize)
+	if err != nil {
+		t.Fatalf("Read() err: %v", err)
+	}
+	n := uintptr(levelSize) * unsafe.Sizeof(base.PageNumber(0))
+	copy(buf[metaSize010:metaSize010+n], buf[metaSize:metaSize+n])
+	for i := metaSize010 + n; i < metaSize+n; i++ {
+		buf[i] = 0
+	}
+	(*meta)(unsafe.Pointer(&buf[0])).version = version010
+	binary.BigEndian.PutUint64(buf[base.PageDataUpper:], storage.Sum64(buf[:base.PageDataUpper]))
+	if err := storage.Write(file, 0, buf); err != nil {
+		t.Fatalf("Write() err: %v", err)
+	}
+	file.Close()
+
+	ing, err = Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() again err: %v", err)
+	}
+	defer ing.Close(true)
+
+	if ing.meta.version != version {
+		t.Errorf("version: got = %o, want = %o", ing.meta.version, version)
+	}
+	if ing.levelNum < 2 {
+		t.Errorf("levels: got = %v, want >= 2", ing.levelNum)
+	}
+	err = ing.View(func(txn *Txn) error {
+		for i := 0; i < 500; i++ {
+			got, err := txn.Get(key(i))
+			if err != nil {
+				return fmt.Errorf("key %d: %w", i, err)
+			}
+			if !bytes.Equal(got, key(i)) {
+				return fmt.Errorf("key %d: got wrong value", i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Get() err: %v", err)
+	}
+}
@@ -55,7 +55,7 @@ func NewIndexEntry(mmgr *memory.MemoryManager, key []byte, value base.PageNumber
 	copy(ie[ieHeaderSize:], key)
 	binary.BigEndian.PutUint64(ie[ieHeaderSize+ks:], uint64(value))
 
-	return ie
+	return ie[:ts]
 }
 
 func (ie IndexEntry) KeySize() base.OffsetNumber {
@@ -67,7 +67,7 @@ func (ie IndexEntry) Key() []byte {
 }
 
 func (ie IndexEntry) Value() base.PageNumber {
-	return base.PageNumber(binary.BigEndian.Uint64(ie[ieHeaderSize:]))
+	return base.PageNumber(binary.BigEndian.Uint64(ie[ieHeaderSize+ie.KeySize():]))
 }
 
 func (ie IndexEntry) Size() base.OffsetNumber {
@@ -138,12 +138,13 @@ func NewDataEntry(mmgr *memory.MemoryManager, tid base.TransactionId, key, value
 	binary.BigEndian.PutUint16(de[deTotalSizePos:], uint16(ts))
 	de[deStatusPos] = 0
 	binary.BigEndian.PutUint64(de[deTidPos:], uint64(tid))
+	binary.BigEndian.PutUint64(de[deUndoRecPtrPos:], uint64(base.InvalidUndoRecordPtr))
 
 	// key and value
 	copy(de[deHeaderSize:deHeaderSize+ks], key)
 	copy(de[deHeaderSize+ks:deHeaderSize+ks+vs], value)
 
-	return de
+	return de[:ts]
 }
 
 func (de DataEntry) KeySize() base.OffsetNumber {
@@ -158,6 +159,10 @@ func (de DataEntry) Tid() base.TransactionId {
 	return base.TransactionId(binary.BigEndian.Uint64(de[deTidPos:]))
 }
 
+func (de DataEntry) Prev() base.UndoRecordPtr {
+	return base.UndoRecordPtr(binary.BigEndian.Uint64(de[deUndoRecPtrPos:]))
+}
+
 func (de DataEntry) Key() []byte {
 	return de[deHeaderSize : deHeaderSize+de.KeySize()]
 }
@@ -3,6 +3,7 @@ package nodes
 import (
 	"bytes"
 	. "github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/memory"
 	"testing"
 )
 
@@ -17,27 +18,28 @@ func TestIndexEntry(t *testing.T) {
 		{"abcde -> 12345", []byte("abcde"), 12345, 54321},
 	}
 
+	mmgr := memory.NewMemoryManager(16, 64*1024)
 	for _, tt := range test {
-		ie := FormIndexEntry(tt.key, tt.oldValue)
+		ie := NewIndexEntry(mmgr, tt.key, tt.oldValue)
 		if int(ie.KeySize()) != len(tt.key) {
-			t.Errorf("FormIndexEntry() KeySize: got = %v, want = %v", int(ie.KeySize()), len(tt.key))
+			t.Errorf("NewIndexEntry() KeySize: got = %v, want = %v", int(ie.KeySize()), len(tt.key))
 		}
 		if bytes.Compare(ie.Key(), tt.key) != 0 {
-			t.Errorf("FormIndexEntry() key: got = %v, want = %v", ie.Key(), tt.key)
+			t.Errorf("NewIndexEntry() key: got = %v, want = %v", ie.Key(), tt.key)
 		}
 		if ie.Value() != tt.oldValue {
-			t.Errorf("FormIndexEntry() oldValue: got = %v, want = %v", ie.Key(), tt.key)
+			t.Errorf("NewIndexEntry() oldValue: got = %v, want = %v", ie.Value(), tt.oldValue)
 		}
 
-		ie.SetValue(54321)
+		ie.UpdateValue(tt.newValue)
 		if int(ie.KeySize()) != len(tt.key) {
-			t.Errorf("FormIndexEntry() KeySize: got = %v, want = %v", int(ie.KeySize()), len(tt.key))
+			t.Errorf("UpdateValue() KeySize: got = %v, want = %v", int(ie.KeySize()), len(tt.key))
 		}
 		if bytes.Compare(ie.Key(), tt.key) != 0 {
-			t.Errorf("FormIndexEntry() key: got = %v, want = %v", ie.Key(), tt.key)
+			t.Errorf("UpdateValue() key: got = %v, want = %v", ie.Key(), tt.key)
 		}
 		if ie.Value() != tt.newValue {
-			t.Errorf("FormIndexEntry() newValue: got = %v, want = %v", ie.Key(), tt.key)
+			t.Errorf("UpdateValue() newValue: got = %v, want = %v", ie.Value(), tt.newValue)
 		}
 	}
 }
@@ -46,25 +48,40 @@ func TestDataEntry(t *testing.T) {
 	test := []struct {
 		name string
 
+		tid   TransactionId
 		key   []byte
 		value []byte
 	}{
-		{"abcde -> 12345", []byte("abcde"), []byte("12345")},
+		{"abcde -> 12345", 1, []byte("abcde"), []byte("12345")},
 	}
 
+	mmgr := memory.NewMemoryManager(16, 64*1024)
 	for _, tt := range test {
-		de := FormDataEntry(tt.key, tt.value)
+		de := NewDataEntry(mmgr, tt.tid, tt.key, tt.value)
 		if int(de.KeySize()) != len(tt.key) {
-			t.Errorf("FormDataEntry() KeySize: got = %v, want = %v", int(de.KeySize()), len(tt.key))
+			t.Errorf("NewDataEntry() KeySize: got = %v, want = %v", int(de.KeySize()), len(tt.key))
 		}
 		if bytes.Compare(de.Key(), tt.key) != 0 {
-			t.Errorf("FormDataEntry() key: got = %v, want = %v", de.Key(), tt.key)
+			t.Errorf("NewDataEntry() key: got = %v, want = %v", de.Key(), tt.key)
 		}
 		if int(de.ValueSize()) != len(tt.value) {
-			t.Errorf("FormDataEntry() ValueSize: got = %v, want = %v", int(de.ValueSize()), len(tt.value))
+			t.Errorf("NewDataEntry() ValueSize: got = %v, want = %v", int(de.ValueSize()), len(tt.value))
 		}
 		if bytes.Compare(de.Value(), tt.value) != 0 {
-			t.Errorf("FormDataEntry() Value: got = %v, want = %v", de.Value(), tt.value)
+			t.Errorf("NewDataEntry() Value: got = %v, want = %v", de.Value(), tt.value)
+		}
+		if de.Tid() != tt.tid || de.IsDead() {
+			t.Errorf("NewDataEntry() tid: got = %v, %v, want = %v, false", de.Tid(), de.IsDead(), tt.tid)
+		}
+
+		de.UpdateTid(InvalidTid)
+		de.UpdateUndoRecordPtr(InvalidUndoRecordPtr)
+		de.MarkDead()
+		if de.Tid() != InvalidTid || de.Prev() != InvalidUndoRecordPtr || !de.IsDead() {
+			t.Errorf("MarkDead() entry: got = %v, %v, %v", de.Tid(), de.Prev(), de.IsDead())
+		}
+		if bytes.Compare(de.Key(), tt.key) != 0 {
+			t.Errorf("MarkDead() key: got = %v, want = %v", de.Key(), tt.key)
 		}
 	}
 }
@@ -5,8 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"github/suixinpr/ingens/base"
-	"github/suixinpr/ingens/manager/buffer"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -20,9 +20,9 @@ const (
 )
 
 type Node struct {
-	mu      sync.RWMutex
-	buf     *buffer.Buffer
-	isDirty bool
+	mu    sync.RWMutex
+	smgr  *StorageManager
+	dirty uint32 // 修改页面时设置，释放引用时标记缓冲池中的脏页
 
 	header pageHeader // header is cache
 	page   Page
@@ -37,6 +37,9 @@ func (n *Node) Init(pageId base.PageNumber, level uint16) {
 	n.header.lower = pageHeaderSize
 	n.header.upper = base.PageDataUpper
 	n.header.level = level
+	n.header.left = base.InvalidPageId
+	n.header.right = base.InvalidPageId
+	n.MarkDirty()
 }
 
 // get
@@ -45,6 +48,10 @@ func (n *Node) GetPageId() base.PageNumber {
 	return n.header.pageId
 }
 
+func (n *Node) GetBeginOff() base.OffsetNumber {
+	return pageHeaderSize
+}
+
 func (n *Node) GetEndOff() base.OffsetNumber {
 	return n.header.lower
 }
@@ -119,11 +126,8 @@ func (n *Node) GetHighKey() []byte {
 }
 
 func (n *Node) GetEntry(off base.OffsetNumber) []byte {
-	if n.IsLeaf() {
-		return n.page.getDataEntry(off)
-	} else {
-		return n.page.getIndexEntry(off)
-	}
+	ptr := n.page.getEntryPtr(off)
+	return n.page[ptr : ptr+n.GetEntrySize(off)]
 }
 
 func (n *Node) GetIndexEntry(off base.OffsetNumber) IndexEntry {
@@ -147,6 +151,63 @@ func (n *Node) Insert(off base.OffsetNumber, entry []byte) {
 	copy(n.page[off+EntryPtrSize:n.header.lower+EntryPtrSize], n.page[off:n.header.lower])
 	binary.BigEndian.PutUint16(n.page[off:], uint16(n.header.upper))
 	n.header.lower += EntryPtrSize
+	n.MarkDirty()
+}
+
+// 替换off处的entry，entry不大于原entry时原地写入，否则写入空闲空间
+// 原entry多余的空间由Compact回收
+// 在调用该函数前应该确保off的正确性和空闲空间足够
+func (n *Node) Replace(off base.OffsetNumber, entry []byte) {
+	size := base.OffsetNumber(len(entry))
+	n.MarkDirty()
+
+	// 原地写入
+	if size <= n.GetEntrySize(off) {
+		ptr := n.page.getEntryPtr(off)
+		copy(n.page[ptr:ptr+size], entry)
+		return
+	}
+
+	// 写入空闲空间，修改entryPtr
+	copy(n.page[n.header.upper-size:n.header.upper], entry)
+	n.header.upper -= size
+	binary.BigEndian.PutUint16(n.page[off:], uint16(n.header.upper))
+}
+
+// 删除off处的entryPtr，entry本身占用的空间由Compact回收
+func (n *Node) Delete(off base.OffsetNumber) {
+	copy(n.page[off:n.header.lower-EntryPtrSize], n.page[off+EntryPtrSize:n.header.lower])
+	n.header.lower -= EntryPtrSize
+	n.MarkDirty()
+}
+
+// 将有效的entry移动到页面末尾，回收Delete和Replace留下的空间
+// 返回回收的空间大小，页面中没有碎片时不移动
+func (n *Node) Compact() base.OffsetNumber {
+	var live base.OffsetNumber
+	for off := pageHeaderSize; off < n.header.lower; off += EntryPtrSize {
+		live += n.GetEntrySize(off)
+	}
+
+	garbage := base.PageDataUpper - n.header.upper - live
+	if garbage == 0 {
+		return 0
+	}
+
+	// 按entryPtr的顺序复制到临时空间，再写回页面
+	tmp := make([]byte, base.PageDataUpper)
+	upper := base.PageDataUpper
+	for off := pageHeaderSize; off < n.header.lower; off += EntryPtrSize {
+		entry := n.GetEntry(off)
+		upper -= base.OffsetNumber(len(entry))
+		copy(tmp[upper:], entry)
+		binary.BigEndian.PutUint16(n.page[off:], uint16(upper))
+	}
+	copy(n.page[upper:base.PageDataUpper], tmp[upper:])
+	n.header.upper = upper
+	n.MarkDirty()
+
+	return garbage
 }
 
 // Entry
@@ -170,7 +231,7 @@ func (n *Node) BinarySearch(key []byte) (base.OffsetNumber, bool) {
 	// [low, high) binary search
 	for low < high {
 		mid := (low & high) + (low^high)>>1
-		result := bytes.Compare(n.GetKey(mid), key)
+		result := bytes.Compare(n.GetKey(arrayToOffset(mid)), key)
 		if result == 0 {
 			return arrayToOffset(mid), true
 		} else if result < 0 {
@@ -183,23 +244,48 @@ func (n *Node) BinarySearch(key []byte) (base.OffsetNumber, bool) {
 	return arrayToOffset(low), false
 }
 
-// 重定向索引entry
-func (n *Node) RedirectEntry(dst, src base.PageNumber) error {
+// 在非叶子节点中查找key所在的子节点，返回对应IndexEntry的位置
+// 最右节点的最后一个IndexEntry指向的子节点没有上界，它的key不参与查找
+func (n *Node) SearchChild(key []byte) base.OffsetNumber {
+	last := n.header.lower - EntryPtrSize
+	if !n.IsRightmost() {
+		off, _ := n.BinarySearch(key)
+		return off
+	}
+
+	low := offsetToArray(pageHeaderSize)
+	high := offsetToArray(last)
+
+	// [low, high) binary search
+	for low < high {
+		mid := (low & high) + (low^high)>>1
+		if bytes.Compare(n.GetKey(arrayToOffset(mid)), key) < 0 {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return arrayToOffset(low)
+}
+
+// 重定向索引entry，返回该entry的位置
+func (n *Node) RedirectEntry(dst, src base.PageNumber) (base.OffsetNumber, error) {
 	for off := pageHeaderSize; off < n.header.lower; off += EntryPtrSize {
 		entry := n.page.getIndexEntry(off)
 		if entry.Value() == src {
 			entry.UpdateValue(dst)
-			return nil
+			n.MarkDirty()
+			return off, nil
 		}
 	}
-	return errNotFound
+	return 0, errNotFound
 }
 
 // 将page的数据拆分为page和rpage
 // 拆分后page为左页面，rpage为右页面
 func (n *Node) Split(rn *Node, insertLoc base.OffsetNumber, insertSize base.OffsetNumber, entry []byte, opr uint8) error {
 	// 页面中至少需要两个entry
-	if offsetToArray(n.header.upper) < 2 {
+	if offsetToArray(n.header.lower) < 2 {
 		return errSplitNode
 	}
 
@@ -224,30 +310,37 @@ func (n *Node) Split(rn *Node, insertLoc base.OffsetNumber, insertSize base.Offs
 	}
 
 	// finish
+	// pageId 和 level 不变，其他线程释放引用时会读取 pageId
 	ln.WriteHeaderToPage()
 	copy(n.page, ln.page)
-	n.WritePageToHeader()
+	n.header.lower = ln.header.lower
+	n.header.upper = ln.header.upper
+	n.header.left = ln.header.left
+	n.header.right = ln.header.right
+	n.MarkDirty()
 	return nil
 }
 
 // 查找拆分位置
 func (n *Node) findSplitLocForInsert(insertLoc base.OffsetNumber, insertSize base.OffsetNumber) base.OffsetNumber {
-	var leftSize, splicLoc base.OffsetNumber
+	var splicLoc base.OffsetNumber
+	var leftSize int
 
-	//在左右页面大小相同的情况下，把最后一个entry放在左边
-	splitSize := ((base.PageDataUpper - n.header.upper) + (n.header.lower - pageHeaderSize) + insertSize + 1) / 2
+	// 在左右页面大小相同的情况下，把最后一个entry放在左边
+	// 页面已满时总大小可能超过 OffsetNumber 的范围，用 int 计算
+	splitSize := (int(base.PageDataUpper-n.header.upper) + int(n.header.lower-pageHeaderSize) + int(insertSize) + 1) / 2
 
 	for off := pageHeaderSize; off <= n.header.lower; off += EntryPtrSize {
-		var size base.OffsetNumber
+		var size int
 		if off < insertLoc {
 			/* left of the insertion position */
-			size = n.GetEntrySize(off) + EntryPtrSize
+			size = int(n.GetEntrySize(off) + EntryPtrSize)
 		} else if off > insertLoc {
 			/* right of the insertion position */
-			size = n.GetEntrySize(off-EntryPtrSize) + EntryPtrSize
+			size = int(n.GetEntrySize(off-EntryPtrSize) + EntryPtrSize)
 		} else {
 			/* the insertion position */
-			size = insertSize + EntryPtrSize
+			size = int(insertSize + EntryPtrSize)
 		}
 		if leftSize+size > splitSize {
 			if leftSize+size-splitSize > splitSize-leftSize {
@@ -263,24 +356,22 @@ func (n *Node) findSplitLocForInsert(insertLoc base.OffsetNumber, insertSize bas
 	return splicLoc
 }
 
-// 查找拆分位置
+// 查找拆分位置，insertLoc处的entry被替换
 func (n *Node) findSplitLocForUpdate(insertLoc base.OffsetNumber, insertSize base.OffsetNumber) base.OffsetNumber {
-	var leftSize, splicLoc base.OffsetNumber
+	var splicLoc base.OffsetNumber
+	var leftSize int
 
-	//在左右页面大小相同的情况下，把最后一个entry放在左边
-	splitSize := ((base.PageDataUpper - n.header.upper) + (n.header.lower - pageHeaderSize) + insertSize + 1) / 2
+	// 在左右页面大小相同的情况下，把最后一个entry放在左边
+	splitSize := (int(base.PageDataUpper-n.header.upper) + int(n.header.lower-pageHeaderSize) -
+		int(n.GetEntrySize(insertLoc)) + int(insertSize) + 1) / 2
 
-	for off := pageHeaderSize; off <= n.header.lower; off += EntryPtrSize {
-		var size base.OffsetNumber
-		if off < insertLoc {
-			/* left of the insertion position */
-			size = n.GetEntrySize(off) + EntryPtrSize
-		} else if off > insertLoc {
-			/* right of the insertion position */
-			size = n.GetEntrySize(off-EntryPtrSize) + EntryPtrSize
+	for off := pageHeaderSize; off < n.header.lower; off += EntryPtrSize {
+		var size int
+		if off != insertLoc {
+			size = int(n.GetEntrySize(off) + EntryPtrSize)
 		} else {
-			/* the insertion position */
-			size = insertSize + EntryPtrSize
+			/* the update position */
+			size = int(insertSize + EntryPtrSize)
 		}
 		if leftSize+size > splitSize {
 			if leftSize+size-splitSize > splitSize-leftSize {
@@ -328,30 +419,19 @@ func (n *Node) splitForInsert(ln, rn *Node, insertLoc, splitLoc base.OffsetNumbe
 
 func (n *Node) splitForUpdate(ln, rn *Node, insertLoc, splitLoc base.OffsetNumber, entry []byte) {
 	// 分别处理左右节点数据
-	// 循环的为插入entry后的数组
-	for off := pageHeaderSize; off <= n.header.lower; off += EntryPtrSize {
+	// 循环的为替换entry后的数组
+	for off := pageHeaderSize; off < n.header.lower; off += EntryPtrSize {
+		e := n.GetEntry(off)
+		if off == insertLoc {
+			/* the update position */
+			e = entry
+		}
+
 		/* decide which page to put it on */
-		if off < insertLoc {
-			/* left of the insertion position */
-			if off < splitLoc {
-				ln.Insert(ln.header.lower, n.GetEntry(off))
-			} else {
-				rn.Insert(rn.header.lower, n.GetEntry(off))
-			}
-		} else if off > insertLoc {
-			/* right of the insertion position */
-			if off < splitLoc {
-				ln.Insert(ln.header.lower, n.GetEntry(off-EntryPtrSize))
-			} else {
-				rn.Insert(rn.header.lower, n.GetEntry(off-EntryPtrSize))
-			}
+		if off < splitLoc {
+			ln.Insert(ln.header.lower, e)
 		} else {
-			/* the insertion position */
-			if off < splitLoc {
-				ln.Insert(ln.header.lower, entry)
-			} else {
-				rn.Insert(rn.header.lower, entry)
-			}
+			rn.Insert(rn.header.lower, e)
 		}
 	}
 }
@@ -374,8 +454,19 @@ func (n *Node) Unlock() {
 	n.mu.Unlock()
 }
 
+// MarkDirty 标记页面已被修改，调用者需要持有写锁
+// Insert、Replace 等修改页面的方法会自动标记，直接修改 GetDataEntry 返回的 entry 时需要调用
+func (n *Node) MarkDirty() {
+	atomic.StoreUint32(&n.dirty, 1)
+}
+
+// Release 释放 getNode 获取的引用，被修改过的页面标记为脏页
 func (n *Node) Release() {
-	n.buf.Release()
+	key := PageKey(n.header.pageId)
+	if atomic.SwapUint32(&n.dirty, 0) == 1 {
+		n.smgr.bmgr.MarkDirty(key)
+	}
+	n.smgr.bmgr.ReleaseBufferData(key)
 }
 
 // IO
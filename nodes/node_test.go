@@ -1 +1,466 @@
 package nodes
+
+import (
+	"bytes"
+	. "github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/memory"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	test := []struct {
+		name string
+
+		oldValue []byte
+		newValue []byte
+	}{
+		{"same size", []byte("12345"), []byte("54321")},
+		{"smaller", []byte("12345"), []byte("1")},
+		{"larger", []byte("1"), []byte("1234567890")},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 0)
+
+			old := NewDataEntry(mmgr, 1, []byte("key"), tt.oldValue)
+			n.Insert(n.GetBeginOff(), old)
+			free := n.FreeSpaceSize()
+
+			de := NewDataEntry(mmgr, 2, []byte("key"), tt.newValue)
+			n.Replace(n.GetBeginOff(), de)
+
+			if n.GetEndOff() != n.GetBeginOff()+EntryPtrSize {
+				t.Errorf("Replace() entries: got = %v, want = 1", (n.GetEndOff()-n.GetBeginOff())/EntryPtrSize)
+			}
+			got := n.GetDataEntry(n.GetBeginOff())
+			if got.Tid() != 2 || bytes.Compare(got.Value(), tt.newValue) != 0 {
+				t.Errorf("Replace() value: got = %v, want = %v", got.Value(), tt.newValue)
+			}
+
+			wantFree := free
+			if de.Size() > old.Size() {
+				wantFree -= de.Size()
+			}
+			if n.FreeSpaceSize() != wantFree {
+				t.Errorf("Replace() free space: got = %v, want = %v", n.FreeSpaceSize(), wantFree)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	test := []struct {
+		name string
+
+		keys    []string
+		deletes []string
+		updates map[string]string
+	}{
+		{"no garbage", []string{"a", "b", "c"}, nil, nil},
+		{"delete", []string{"a", "b", "c", "d"}, []string{"b", "d"}, nil},
+		{"update", []string{"a", "b", "c"}, nil, map[string]string{"a": "", "c": "cccccccccc"}},
+		{"delete and update", []string{"a", "b", "c", "d"}, []string{"a"}, map[string]string{"b": "bbbbbbbb", "d": ""}},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 0)
+
+			want := make(map[string]string)
+			for _, k := range tt.keys {
+				n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte(k), []byte(k+k)))
+				want[k] = k + k
+			}
+			for _, k := range tt.deletes {
+				n.Delete(findOff(n, k))
+				delete(want, k)
+			}
+			for k, v := range tt.updates {
+				n.Replace(findOff(n, k), NewDataEntry(mmgr, 2, []byte(k), []byte(v)))
+				want[k] = v
+			}
+
+			var live OffsetNumber
+			for off := n.GetBeginOff(); off < n.GetEndOff(); off += EntryPtrSize {
+				live += n.GetEntrySize(off)
+			}
+			wantGarbage := PageDataUpper - n.header.upper - live
+
+			if got := n.Compact(); got != wantGarbage {
+				t.Errorf("Compact() garbage: got = %v, want = %v", got, wantGarbage)
+			}
+			if got := n.Compact(); got != 0 {
+				t.Errorf("Compact() second garbage: got = %v, want = 0", got)
+			}
+
+			wantFree := PageDataUpper - n.GetEndOff() - live
+			if n.FreeSpaceSize() != wantFree {
+				t.Errorf("Compact() free space: got = %v, want = %v", n.FreeSpaceSize(), wantFree)
+			}
+
+			if int(n.GetEndOff()-n.GetBeginOff())/int(EntryPtrSize) != len(want) {
+				t.Errorf("Compact() entries: got = %v, want = %v", (n.GetEndOff()-n.GetBeginOff())/EntryPtrSize, len(want))
+			}
+			for off := n.GetBeginOff(); off < n.GetEndOff(); off += EntryPtrSize {
+				de := n.GetDataEntry(off)
+				if v, ok := want[string(de.Key())]; !ok || v != string(de.Value()) {
+					t.Errorf("Compact() entry %s: got = %s, want = %s", de.Key(), de.Value(), v)
+				}
+			}
+		})
+	}
+}
+
+func TestInit(t *testing.T) {
+	test := []struct {
+		name string
+
+		pageId PageNumber
+		level  uint16
+	}{
+		{"leaf", 1, 0},
+		{"non-leaf", 2, 1},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(tt.pageId, tt.level)
+			if n.GetPageId() != tt.pageId {
+				t.Errorf("Init() pageId: got = %v, want = %v", n.GetPageId(), tt.pageId)
+			}
+			if n.GetLevel() != tt.level || n.IsLeaf() != (tt.level == 0) {
+				t.Errorf("Init() level: got = %v, want = %v", n.GetLevel(), tt.level)
+			}
+			if n.GetBeginOff() != n.GetEndOff() || !n.IsLeftmost() || !n.IsRightmost() {
+				t.Errorf("Init() node is not empty")
+			}
+		})
+	}
+}
+
+func TestInsert(t *testing.T) {
+	keys := []string{"nil", "IndexEntry", "RepeatedIndexEntry", "DataEntry", "RepeatedDataEntry"}
+
+	test := []struct {
+		name string
+
+		level uint16
+		entry func(mmgr *memory.MemoryManager, i int) []byte
+	}{
+		{"IndexEntry", 1, func(mmgr *memory.MemoryManager, i int) []byte {
+			return NewIndexEntry(mmgr, []byte(keys[i]), PageNumber(i+1))
+		}},
+		{"DataEntry", 0, func(mmgr *memory.MemoryManager, i int) []byte {
+			return NewDataEntry(mmgr, 1, []byte(keys[i]), []byte(keys[i]))
+		}},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, tt.level)
+			for i := range keys {
+				off, found := n.BinarySearch([]byte(keys[i]))
+				if found {
+					t.Fatalf("BinarySearch() %s: found before insert", keys[i])
+				}
+				n.Insert(off, tt.entry(mmgr, i))
+			}
+
+			// 页面中的 key 有序
+			for off := n.GetBeginOff(); off+EntryPtrSize < n.GetEndOff(); off += EntryPtrSize {
+				if bytes.Compare(n.GetKey(off), n.GetKey(off+EntryPtrSize)) >= 0 {
+					t.Errorf("Insert() order: %s >= %s", n.GetKey(off), n.GetKey(off+EntryPtrSize))
+				}
+			}
+			for i := range keys {
+				off, found := n.BinarySearch([]byte(keys[i]))
+				if !found {
+					t.Errorf("BinarySearch() %s: found = %v, want = %v", keys[i], found, true)
+					continue
+				}
+				if e := tt.entry(mmgr, i); bytes.Compare(n.GetEntry(off), e) != 0 {
+					t.Errorf("GetEntry() %s: got = %v, want = %v", keys[i], n.GetEntry(off), e)
+				}
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	test := []struct {
+		name string
+
+		keys   []string
+		insert string
+	}{
+		{"left", []string{"b", "d"}, "a"},
+		{"middle", []string{"b", "d"}, "c"},
+		{"right", []string{"b", "d"}, "e"},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 0)
+			for _, k := range tt.keys {
+				n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte(k), []byte(k)))
+			}
+
+			rn := NewNode()
+			rn.Init(2, 0)
+			de := NewDataEntry(mmgr, 1, []byte(tt.insert), []byte(tt.insert))
+			off, _ := n.BinarySearch([]byte(tt.insert))
+			if err := n.Split(rn, off, de.Size(), de, SPLIT_INSERT); err != nil {
+				t.Fatalf("Split() err: %v", err)
+			}
+			if n.GetRight() != rn.GetPageId() || rn.GetLeft() != n.GetPageId() {
+				t.Errorf("Split() link: got = %v, %v, want = %v, %v", n.GetRight(), rn.GetLeft(), rn.GetPageId(), n.GetPageId())
+			}
+			if n.IsRightmost() || !rn.IsRightmost() {
+				t.Errorf("Split() rightmost: got = %v, %v, want = false, true", n.IsRightmost(), rn.IsRightmost())
+			}
+
+			// 每个 key 只在一个节点中，左节点的 key 都不大于 high key
+			for _, k := range append(tt.keys, tt.insert) {
+				_, found1 := n.BinarySearch([]byte(k))
+				_, found2 := rn.BinarySearch([]byte(k))
+				if found1 == found2 {
+					t.Errorf("Split() found %s: got = %v, %v", k, found1, found2)
+				}
+				if found1 && bytes.Compare([]byte(k), n.GetHighKey()) > 0 {
+					t.Errorf("Split() key %s is larger than high key %s", k, n.GetHighKey())
+				}
+				if found2 && bytes.Compare([]byte(k), n.GetHighKey()) <= 0 {
+					t.Errorf("Split() key %s is not larger than high key %s", k, n.GetHighKey())
+				}
+			}
+		})
+	}
+}
+
+func TestDeadHighKey(t *testing.T) {
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+
+	// 非最右节点
+	n := NewNode()
+	n.Init(1, 0)
+	n.header.right = 2
+	for _, k := range []string{"a", "b", "c"} {
+		n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte(k), []byte(k)))
+	}
+
+	// 删除其他 entry，最后一个 entry 保留为 dead entry
+	last := n.GetEndOff() - EntryPtrSize
+	de := n.GetDataEntry(last)
+	de.UpdateTid(InvalidTid)
+	de.UpdateUndoRecordPtr(InvalidUndoRecordPtr)
+	de.MarkDead()
+	n.Delete(n.GetBeginOff())
+	n.Delete(n.GetBeginOff())
+	n.Compact()
+
+	if n.GetEndOff() != n.GetBeginOff()+EntryPtrSize {
+		t.Fatalf("Delete() entries: got = %v, want = 1", (n.GetEndOff()-n.GetBeginOff())/EntryPtrSize)
+	}
+	if got := n.GetHighKey(); string(got) != "c" {
+		t.Errorf("GetHighKey(): got = %s, want = c", got)
+	}
+	if de := n.GetDataEntry(n.GetBeginOff()); !de.IsDead() || de.Tid() != InvalidTid {
+		t.Errorf("high key entry: got = %v, %v, want = true, %v", de.IsDead(), de.Tid(), InvalidTid)
+	}
+}
+
+func TestMarkDirty(t *testing.T) {
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	test := []struct {
+		name string
+
+		op   func(n *Node)
+		want uint32
+	}{
+		{"read only", func(n *Node) {
+			off, _ := n.BinarySearch([]byte("b"))
+			n.GetDataEntry(off)
+		}, 0},
+		{"compact without garbage", func(n *Node) { n.Compact() }, 0},
+		{"insert", func(n *Node) { n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte("c"), []byte("c"))) }, 1},
+		{"replace", func(n *Node) { n.Replace(n.GetBeginOff(), NewDataEntry(mmgr, 2, []byte("a"), []byte("x"))) }, 1},
+		{"delete", func(n *Node) { n.Delete(n.GetBeginOff()) }, 1},
+		{"update entry", func(n *Node) {
+			n.GetDataEntry(n.GetBeginOff()).MarkDead()
+			n.MarkDirty()
+		}, 1},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 0)
+			n.Insert(n.GetBeginOff(), NewDataEntry(mmgr, 1, []byte("a"), []byte("a")))
+			n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte("b"), []byte("b")))
+			n.dirty = 0
+
+			// 只读的遍历持有写锁时不标记脏页
+			n.Lock()
+			tt.op(n)
+			n.Unlock()
+			if n.dirty != tt.want {
+				t.Errorf("dirty: got = %v, want = %v", n.dirty, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsertEntryError(t *testing.T) {
+	test := []struct {
+		name string
+
+		level uint16
+		keys  []string
+		want  int // 第一个重复 key 的下标，-1 表示没有重复
+	}{
+		{"IndexEntry", 1, []string{"nil", "IndexEntry", "DataEntry"}, -1},
+		{"RepeatedIndexEntry", 1, []string{"RepeatedIndexEntry", "RepeatedIndexEntry"}, 1},
+		{"ManyRepeatedIndexEntry", 1, []string{
+			"nil", "IndexEntry", "RepeatedIndexEntry", "DataEntry", "RepeatedDataEntry",
+			"nil", "IndexEntry", "RepeatedIndexEntry", "DataEntry", "RepeatedDataEntry",
+		}, 5},
+		{"RepeatedDataEntry", 0, []string{"RepeatedDataEntry", "RepeatedDataEntry"}, 1},
+		{"ManyDataEntry", 0, []string{
+			"nil", "IndexEntry", "RepeatedIndexEntry", "DataEntry", "RepeatedDataEntry",
+			"IndexEntry", "nil", "RepeatedIndexEntry", "DataEntry", "RepeatedDataEntry",
+		}, 5},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, tt.level)
+
+			// Insert 不检查重复，调用者通过 BinarySearch 发现重复的 key
+			got := -1
+			for i, k := range tt.keys {
+				off, found := n.BinarySearch([]byte(k))
+				if found {
+					got = i
+					break
+				}
+				if tt.level == 0 {
+					n.Insert(off, NewDataEntry(mmgr, 1, []byte(k), []byte(k)))
+				} else {
+					n.Insert(off, NewIndexEntry(mmgr, []byte(k), PageNumber(i+1)))
+				}
+			}
+			if got != tt.want {
+				t.Errorf("BinarySearch() repeated: got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitError(t *testing.T) {
+	test := []struct {
+		name string
+
+		keys []string
+		opr  uint8
+	}{
+		{"empty", nil, SPLIT_INSERT},
+		{"one entry", []string{"a"}, SPLIT_INSERT},
+		{"one entry update", []string{"a"}, SPLIT_UPDATE},
+		{"unknown opr", []string{"a", "b"}, SPLIT_UPDATE + 1},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 0)
+			for _, k := range tt.keys {
+				n.Insert(n.GetEndOff(), NewDataEntry(mmgr, 1, []byte(k), []byte(k)))
+			}
+
+			rn := NewNode()
+			rn.Init(2, 0)
+			de := NewDataEntry(mmgr, 1, []byte("c"), []byte("c"))
+			if err := n.Split(rn, n.GetEndOff(), de.Size(), de, tt.opr); err != errSplitNode {
+				t.Errorf("Split() err: got = %v, want = %v", err, errSplitNode)
+			}
+		})
+	}
+}
+
+func TestFindSplitLoc(t *testing.T) {
+	test := []struct {
+		name string
+
+		opr       uint8
+		keys      []string
+		insertLoc OffsetNumber // 数组下标
+		insertKey string       // 插入或者替换后的 entry 的 key
+
+		splitLoc OffsetNumber // 数组下标，插入或者替换后的第一个右节点 entry
+	}{
+		// IndexEntry 的大小为 10 + key，加上 entryPtr 为 12 + key
+		{"IndexEntry-1", SPLIT_INSERT, []string{"a", "b"}, 1, "x", 1},
+		{"IndexEntry-2", SPLIT_INSERT, []string{"a", "b", "c"}, 0, "x", 2},
+		{"IndexEntry-3", SPLIT_INSERT, []string{"abcdefg", "h"}, 2, "x", 1},
+		{"IndexEntry-4", SPLIT_INSERT, []string{"a", "bcdefgh"}, 2, "x", 1},
+		{"IndexEntry-5", SPLIT_INSERT, []string{"abcdefg", "h", "i", "j", "k", "l", "m", "n"}, 1, "x", 4},
+		{"IndexEntry-6", SPLIT_INSERT, []string{"a", "b", "c", "d", "e", "f", "g", "hijklmn"}, 7, "x", 5},
+		{"IndexEntry-7", SPLIT_INSERT, []string{"abc", "defg", "hijkl", "mnopq", "rstu", "vwx", "yz"}, 0, "xx", 4},
+		{"IndexEntry-8", SPLIT_INSERT, []string{"abcdefghijklmn", "o"}, 1, "x", 1},
+		{"IndexEntry-9", SPLIT_INSERT, []string{"a", "bcdefghijklmno"}, 1, "x", 2},
+
+		// 替换后的 entry 变大
+		{"Update-1", SPLIT_UPDATE, []string{"a", "b"}, 0, "abcdefghijklmn", 1},
+		{"Update-2", SPLIT_UPDATE, []string{"a", "b"}, 1, "bcdefghijklmno", 1},
+		{"Update-3", SPLIT_UPDATE, []string{"a", "b", "c", "d"}, 0, "abcdefghijklmn", 2},
+		{"Update-4", SPLIT_UPDATE, []string{"a", "b", "c", "d"}, 3, "defghijklmnopq", 3},
+		{"Update-5", SPLIT_UPDATE, []string{"a", "b", "c", "d", "e", "f"}, 2, "cdefg", 3},
+		{"Update-6", SPLIT_UPDATE, []string{"abcdefg", "h", "i", "j", "k", "l", "m", "n"}, 7, "nopqrst", 4},
+	}
+
+	mmgr := memory.NewMemoryManager(16, 64*1024)
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNode()
+			n.Init(1, 1)
+			for i, k := range tt.keys {
+				n.Insert(n.GetEndOff(), NewIndexEntry(mmgr, []byte(k), PageNumber(i+1)))
+			}
+
+			insertLoc := arrayToOffset(tt.insertLoc)
+			insertSize := NewIndexEntry(mmgr, []byte(tt.insertKey), 1).Size()
+
+			var splitLoc OffsetNumber
+			if tt.opr == SPLIT_INSERT {
+				splitLoc = n.findSplitLocForInsert(insertLoc, insertSize)
+			} else {
+				splitLoc = n.findSplitLocForUpdate(insertLoc, insertSize)
+			}
+			if offsetToArray(splitLoc) != tt.splitLoc {
+				t.Errorf("findSplitLoc() splitLoc: got = %v, want = %v", offsetToArray(splitLoc), tt.splitLoc)
+			}
+		})
+	}
+}
+
+func findOff(n *Node, key string) OffsetNumber {
+	for off := n.GetBeginOff(); off < n.GetEndOff(); off += EntryPtrSize {
+		if string(n.GetKey(off)) == key {
+			return off
+		}
+	}
+	return n.GetEndOff()
+}
@@ -1,39 +1,110 @@
 package nodes
 
 import (
+	"encoding/binary"
+	"errors"
 	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/buffer"
+	"github/suixinpr/ingens/manager/storage"
 	"io"
 	"os"
+	"strconv"
 )
 
+var (
+	// errPageChecksum the checksum of a node page is wrong
+	errPageChecksum = errors.New("node page checksum error")
+)
+
+// StorageManager 读写数据文件中的节点页面，页面 0 为 meta，不经过缓冲池
 type StorageManager struct {
-	file os.File
+	file *os.File
+	bmgr *buffer.BufferManager
+
+	// 写回页面之前调用，页面引用的回滚记录需要先于页面落盘
+	writeAhead func() error
+}
+
+func NewStorageManager(file *os.File) *StorageManager {
+	return &StorageManager{file: file}
+}
+
+// SetBufferManager 缓冲池创建后设置，节点通过它释放引用和标记脏页
+func (smgr *StorageManager) SetBufferManager(bmgr *buffer.BufferManager) {
+	smgr.bmgr = bmgr
+}
+
+// SetWriteAhead 设置写回页面之前调用的函数，调用时持有节点读锁
+func (smgr *StorageManager) SetWriteAhead(f func() error) {
+	smgr.writeAhead = f
+}
+
+// PageKey 节点页面在缓冲池中的 key
+func PageKey(pageId base.PageNumber) string {
+	return strconv.FormatUint(uint64(pageId), 10)
+}
+
+func (smgr *StorageManager) InitData() any {
+	n := NewNode()
+	n.smgr = smgr
+	return n
 }
 
 // io 操作，从文件读取页面
-func (smgr *StorageManager) Read(data []byte, pageId uint64) error {
+func (smgr *StorageManager) Read(key string, data any) error {
+	n := data.(*Node)
+	pageId, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return err
+	}
+
 	// 读取数据
 	off := int64(pageId) * int64(base.PageSize)
-	n, err := smgr.file.ReadAt(data, off)
+	size, err := smgr.file.ReadAt(n.page, off)
 
 	// 读取失败
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return err
 	}
 
 	// 读取数据长度不对
-	if n != base.PageSize {
+	if size != base.PageSize {
 		return io.ErrUnexpectedEOF
 	}
 
+	sum := binary.BigEndian.Uint64(n.page[base.PageDataUpper:])
+	if sum != storage.Sum64(n.page[:base.PageDataUpper]) {
+		return errPageChecksum
+	}
+
+	n.WritePageToHeader()
 	return nil
 }
 
-// io 操作，将页面写入文件
-func (smgr *StorageManager) Write(data []byte, pageId uint64) error {
+// io 操作，将页面写入文件，写入期间持有节点读锁
+func (smgr *StorageManager) Write(key string, data any) error {
+	n := data.(*Node)
+	pageId, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+
+	// 修改页面之前已经追加回滚记录，持有读锁时页面上的修改都已经有对应的记录
+	if smgr.writeAhead != nil {
+		if err := smgr.writeAhead(); err != nil {
+			return err
+		}
+	}
+
+	n.WriteHeaderToPage()
+	binary.BigEndian.PutUint64(n.page[base.PageDataUpper:], storage.Sum64(n.page[:base.PageDataUpper]))
+
 	// 写入数据
 	off := int64(pageId) * int64(base.PageSize)
-	n, err := smgr.file.WriteAt(data, off)
+	size, err := smgr.file.WriteAt(n.page, off)
 
 	// 写入失败
 	if err != nil {
@@ -41,7 +112,7 @@ func (smgr *StorageManager) Write(data []byte, pageId uint64) error {
 	}
 
 	// 写入数据长度不对
-	if n != base.PageSize {
+	if size != base.PageSize {
 		return io.ErrShortWrite
 	}
 
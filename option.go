@@ -31,8 +31,67 @@ type Option struct {
 	Timeout time.Duration
 
 	// transaction manager
+	Isolation        IsolationLevel
+	RetryTimes       int           // Exec 遇到可重试错误时的最大重试次数
+	RetryBackoff     time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	VersionRetention time.Duration // 旧版本的保留时间，BeginAt 和 BeginAsOf 只能读取保留期限内的快照
+
+	// purge
+	PurgeInterval  time.Duration      // 后台回收旧版本和 dead entry 的间隔，为 0 时使用默认的间隔
+	MaxUndoSize    int64              // undo 占用空间的上限，为 0 时不限制
+	MaxTxnAge      time.Duration      // 事务运行时间的上限，为 0 时不限制，超出时事务总是被回滚
+	UndoPolicy     UndoPolicy         // undo 空间超出上限时的处理方式
+	OnUndoPressure func(UndoPressure) // 超出上限时由回收线程调用，可以为 nil
 }
 
+// UndoPolicy what to do when the undo log exceeds Option.MaxUndoSize, it is
+// checked after each purge. Transactions running longer than Option.MaxTxnAge
+// are rolled back whatever the policy is
+type UndoPolicy uint8
+
+const (
+	// UndoWarn only call Option.OnUndoPressure
+	UndoWarn UndoPolicy = iota
+
+	// UndoAbortOldest roll back the oldest transaction, which pins the old
+	// versions, its operations return ErrSnapshotTooOld
+	UndoAbortOldest
+
+	// UndoRejectWrites writes return ErrUndoSpaceExhausted until purge
+	// brings the undo log back under Option.MaxUndoSize
+	UndoRejectWrites
+)
+
+// UndoPressure passed to Option.OnUndoPressure
+type UndoPressure struct {
+	UndoSize     int64         // undo 占用的空间
+	OldestTxnAge time.Duration // 最早开始的事务已经运行的时间
+}
+
+// IsolationLevel the isolation level of transactions
+type IsolationLevel uint8
+
+const (
+	// DefaultIsolation use Option.Isolation
+	DefaultIsolation IsolationLevel = iota
+
+	// ReadCommitted each statement reads a new snapshot, writing a key
+	// changed by an uncommitted transaction returns ErrWriteConflict
+	ReadCommitted
+
+	// SnapshotIsolation reads see the snapshot taken when the transaction begins,
+	// writing a key changed by a concurrent transaction returns ErrWriteConflict
+	SnapshotIsolation
+
+	// Serializable snapshot isolation that also tracks read dependencies, the
+	// transaction that could make the result non-serializable (e.g. write skew)
+	// fails at commit with ErrSerializationFailure
+	Serializable
+
+	// RepeatableRead is the same as SnapshotIsolation
+	RepeatableRead = SnapshotIsolation
+)
+
 func DefaultOptions() Option {
 	return Option{
 		// entry
@@ -51,6 +110,16 @@ func DefaultOptions() Option {
 		Timeout: 10 * time.Second,
 
 		// transaction manager
+		Isolation:        SnapshotIsolation,
+		RetryTimes:       3,
+		RetryBackoff:     10 * time.Millisecond,
+		VersionRetention: 0,
+
+		// purge
+		PurgeInterval: time.Second,
+		MaxUndoSize:   0,
+		MaxTxnAge:     0,
+		UndoPolicy:    UndoWarn,
 	}
 }
 
@@ -66,6 +135,15 @@ var (
 
 	// ErrMemoryMinMaxSize MinSize of the memory manager cannot be greater than MaxSize
 	ErrMemoryMinMaxSize = errors.New("ingens: MinSize of the memory manager cannot be greater than MaxSize")
+
+	// ErrUnknownIsolation unknown isolation level
+	ErrUnknownIsolation = errors.New("ingens: unknown isolation level")
+
+	// ErrNegativePurgeInterval
+	ErrNegativePurgeInterval = errors.New("ingens: purge interval cannot be negative")
+
+	// ErrUnknownUndoPolicy unknown undo policy
+	ErrUnknownUndoPolicy = errors.New("ingens: unknown undo policy")
 )
 
 const (
@@ -91,6 +169,24 @@ func (opt *Option) Check() error {
 		return ErrMemoryMinMaxSize
 	}
 
+	if opt.Isolation == DefaultIsolation {
+		opt.Isolation = SnapshotIsolation
+	}
+	if opt.Isolation > Serializable {
+		return ErrUnknownIsolation
+	}
+
+	if opt.PurgeInterval == 0 {
+		opt.PurgeInterval = DefaultOptions().PurgeInterval
+	}
+	if opt.PurgeInterval < 0 {
+		return ErrNegativePurgeInterval
+	}
+
+	if opt.UndoPolicy > UndoRejectWrites {
+		return ErrUnknownUndoPolicy
+	}
+
 	return nil
 }
 
@@ -0,0 +1,170 @@
+package ingens
+
+import (
+	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/nodes"
+	"sync/atomic"
+	"time"
+)
+
+// purgeStats 回收线程的进度
+type purgeStats struct {
+	runs     uint64
+	entries  uint64
+	segments uint64
+	horizon  uint64 // base.CommitSequenceNumber
+	last     int64  // unix nano
+	errors   uint64
+	err      atomic.Value // purgeError，最近一次回收失败的原因
+}
+
+type purgeError struct {
+	err error
+}
+
+// autoPurge 定期回收所有快照都不再需要的旧版本
+func (ing *Ingens) autoPurge() {
+	for {
+		select {
+		case <-time.After(ing.opt.PurgeInterval):
+			if err := ing.purge(); err != nil {
+				atomic.AddUint64(&ing.purgeStats.errors, 1)
+				ing.purgeStats.err.Store(purgeError{err})
+			}
+			ing.checkUndoPressure()
+		case <-ing.closeC:
+			ing.closeB.Done()
+			return
+		}
+	}
+}
+
+// purge 删除叶子节点中的 dead entry，然后删除 undo 段和 commit log
+// 小于 oldest 的事务都已经结束，它们删除的 entry 和覆盖的旧版本对所有快照都不可见
+func (ing *Ingens) purge() error {
+	oldest, csn := ing.tmgr.PurgeHorizon()
+	atomic.StoreUint64(&ing.purgeStats.horizon, uint64(csn))
+
+	// 上次 vacuum 之后没有标记新的 dead entry 时不需要遍历叶子节点
+	if dead := atomic.SwapUint64(&ing.deadEntries, 0); dead > 0 {
+		n, kept, err := ing.vacuum(oldest)
+		atomic.AddUint64(&ing.purgeStats.entries, n)
+		if err != nil {
+			atomic.AddUint64(&ing.deadEntries, dead)
+			return err
+		}
+
+		// 还不能删除的 dead entry 留到下一次
+		atomic.AddUint64(&ing.deadEntries, kept)
+	}
+
+	// 删除 undo 和 commit log 之前写回回滚后的页面和事务状态
+	// 小于 oldest 的事务在磁盘上的结果都已经确定
+	if err := ing.flush(); err != nil {
+		return err
+	}
+
+	segs, err := ing.umgr.Discard(oldest)
+	atomic.AddUint64(&ing.purgeStats.segments, uint64(segs))
+	if err != nil {
+		return err
+	}
+
+	// entry 中小于 oldest 的 tid 都已经提交，回滚的事务已经撤销了修改，截断后读取为 FrozenCsn
+	if err := ing.tmgr.TruncateCommitLog(oldest); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&ing.purgeStats.runs, 1)
+	atomic.StoreInt64(&ing.purgeStats.last, time.Now().UnixNano())
+	return nil
+}
+
+// vacuum 从最左侧的叶子节点开始，删除由小于 oldest 并且已经提交的事务标记的 dead entry
+// 返回删除的数量和还不能删除的数量，数据库关闭时停止
+func (ing *Ingens) vacuum(oldest base.TransactionId) (n, kept uint64, err error) {
+	// 下降到最左侧的叶子节点
+	node, _, err := ing.search(nil)
+	if err != nil {
+		return n, kept, err
+	}
+
+	// 释放读锁，获取写锁
+	node.RUnlock()
+	node.Lock()
+
+	for {
+		for off := node.GetBeginOff(); off < node.GetEndOff(); {
+			// 非最右节点的最后一个 entry 是节点的 high key，保留为 dead entry
+			if off+nodes.EntryPtrSize == node.GetEndOff() && !node.IsRightmost() {
+				break
+			}
+
+			de := node.GetDataEntry(off)
+			if de.IsDead() && de.Tid() < oldest && ing.tmgr.IsCommitted(de.Tid()) {
+				node.Delete(off)
+				n++
+				continue
+			}
+			if de.IsDead() {
+				kept++
+			}
+			off += nodes.EntryPtrSize
+		}
+
+		if node.IsRightmost() || ing.isClosed() {
+			node.Unlock()
+			node.Release()
+			return n, kept, nil
+		}
+
+		// 右移
+		node, err = ing.moveRight(node, true)
+		if err != nil {
+			return n, kept, err
+		}
+	}
+}
+
+// checkUndoPressure 回滚运行时间超出 Option.MaxTxnAge 的事务，undo 空间超出上限时按 Option.UndoPolicy 处理
+func (ing *Ingens) checkUndoPressure() {
+	size := ing.umgr.Size()
+	oldest := ing.oldestTxn()
+	var age time.Duration
+	if oldest != nil {
+		age = time.Since(oldest.start)
+	}
+
+	overSize := ing.opt.MaxUndoSize > 0 && size > ing.opt.MaxUndoSize
+	overAge := ing.opt.MaxTxnAge > 0 && age > ing.opt.MaxTxnAge
+	if !overSize {
+		atomic.StoreUint32(&ing.undoExhausted, 0)
+	}
+	if !overSize && !overAge {
+		return
+	}
+
+	if ing.opt.OnUndoPressure != nil {
+		ing.opt.OnUndoPressure(UndoPressure{UndoSize: size, OldestTxnAge: age})
+	}
+
+	// 超时的事务总是被回滚，与 UndoPolicy 无关
+	// 事务可能正在执行操作，不阻塞回收线程
+	if overAge {
+		for _, txn := range ing.expiredTxns(ing.opt.MaxTxnAge) {
+			go txn.kill()
+		}
+	}
+	if !overSize {
+		return
+	}
+
+	switch ing.opt.UndoPolicy {
+	case UndoAbortOldest:
+		if oldest != nil {
+			go oldest.kill()
+		}
+	case UndoRejectWrites:
+		atomic.StoreUint32(&ing.undoExhausted, 1)
+	}
+}
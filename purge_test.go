@@ -0,0 +1,209 @@
+package ingens
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVacuum(t *testing.T) {
+	path := t.TempDir()
+	opt := DefaultOptions()
+	opt.BufferCapacity = 64
+	opt.PurgeInterval = time.Hour // 由测试调用 purge
+
+	ing, err := Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	defer ing.Close(true)
+
+	key := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{'k'}, MaxKeySize-8)...)
+	}
+	exec := func(f func(txn *Txn, i int) error, from, to int) {
+		err := ing.Exec(func(txn *Txn) error {
+			for i := from; i < to; i++ {
+				if err := f(txn, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Exec() err: %v", err)
+		}
+	}
+	set := func(txn *Txn, i int) error { return txn.Set(key(i), key(i)) }
+	del := func(txn *Txn, i int) error { return txn.Delete(key(i)) }
+
+	exec(set, 0, 1000)
+	exec(del, 0, 900)
+	// 再提交一次，删除所在的提交超出保留期限
+	exec(set, 1000, 1001)
+
+	if err := ing.purge(); err != nil {
+		t.Fatalf("purge() err: %v", err)
+	}
+	if got := ing.Stats().PurgedEntries; got == 0 || got > 900 {
+		t.Errorf("PurgedEntries: got = %v, want in (0, 900]", got)
+	}
+	if got := atomic.LoadUint64(&ing.deadEntries); got != 0 {
+		t.Errorf("deadEntries: got = %v, want = 0", got)
+	}
+
+	// 没有新的 dead entry 时不再遍历叶子节点
+	purged := ing.Stats().PurgedEntries
+	if err := ing.purge(); err != nil {
+		t.Fatalf("purge() again err: %v", err)
+	}
+	if got := ing.Stats().PurgedEntries; got != purged {
+		t.Errorf("PurgedEntries again: got = %v, want = %v", got, purged)
+	}
+
+	// 保留的 high key 使查找和插入仍然落在正确的节点
+	err = ing.View(func(txn *Txn) error {
+		for i := 0; i < 1001; i++ {
+			_, err := txn.Get(key(i))
+			if i < 900 && err != ErrNotFoundEntry {
+				return fmt.Errorf("key %d: got = %v, want = %v", i, err, ErrNotFoundEntry)
+			}
+			if i >= 900 && err != nil {
+				return fmt.Errorf("key %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Get() err: %v", err)
+	}
+
+	exec(set, 0, 900)
+	err = ing.View(func(txn *Txn) error {
+		for i := 0; i < 1001; i++ {
+			if _, err := txn.Get(key(i)); err != nil {
+				return fmt.Errorf("key %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Get() after insert err: %v", err)
+	}
+}
+
+func TestUndoPolicy(t *testing.T) {
+	test := []struct {
+		name string
+
+		policy  UndoPolicy
+		maxSize int64 // undo 至少占用一个页面，1 表示超出上限
+		maxAge  time.Duration
+
+		pressure bool  // 是否调用 OnUndoPressure
+		killed   bool  // 最早的事务是否被回滚
+		writeErr error // 新事务写入的错误
+	}{
+		{"under limits", UndoAbortOldest, 0, time.Hour, false, false, nil},
+		{"warn", UndoWarn, 1, 0, true, false, nil},
+		{"abort oldest", UndoAbortOldest, 1, 0, true, true, nil},
+		{"reject writes", UndoRejectWrites, 1, 0, true, false, ErrUndoSpaceExhausted},
+		{"max txn age", UndoWarn, 0, time.Millisecond, true, true, nil},
+		// 超时的事务被回滚，undo 空间没有超出上限时不拒绝写入
+		{"max txn age reject writes", UndoRejectWrites, 0, time.Millisecond, true, true, nil},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			var pressure bool
+			opt := DefaultOptions()
+			opt.PurgeInterval = time.Hour // 由测试调用 checkUndoPressure
+			opt.UndoPolicy = tt.policy
+			opt.MaxUndoSize = tt.maxSize
+			opt.MaxTxnAge = tt.maxAge
+			opt.OnUndoPressure = func(UndoPressure) { pressure = true }
+			ing := openTest(t, opt)
+			defer ing.Close(true)
+
+			old, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			defer old.Rollback()
+			if err := old.Set([]byte("old"), []byte("1")); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			ing.checkUndoPressure()
+			if pressure != tt.pressure {
+				t.Errorf("OnUndoPressure: got = %v, want = %v", pressure, tt.pressure)
+			}
+
+			// kill 在单独的协程中回滚事务
+			if tt.killed {
+				select {
+				case <-old.done:
+				case <-time.After(time.Second):
+				}
+			}
+			_, err = old.Get([]byte("old"))
+			if killed := err == ErrSnapshotTooOld; killed != tt.killed {
+				t.Errorf("oldest killed: got = %v (%v), want = %v", killed, err, tt.killed)
+			}
+
+			err = ing.Exec(func(txn *Txn) error { return txn.Set([]byte("new"), []byte("1")) })
+			if err != tt.writeErr {
+				t.Errorf("Set() err: got = %v, want = %v", err, tt.writeErr)
+			}
+
+			// 回滚不受 UndoRejectWrites 影响，undo 空间回到上限之内后可以再次写入
+			if err := old.Rollback(); err != nil && !tt.killed {
+				t.Errorf("Rollback() err: %v", err)
+			}
+			ing.opt.MaxUndoSize = 0
+			ing.checkUndoPressure()
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("new"), []byte("2")) }); err != nil {
+				t.Errorf("Set() after pressure err: %v", err)
+			}
+			if err := checkValues(ing, map[string]string{"old": "", "new": "2"}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPurgeInterval(t *testing.T) {
+	test := []struct {
+		name string
+
+		interval time.Duration
+		want     time.Duration
+		err      error
+	}{
+		{"default", 0, DefaultOptions().PurgeInterval, nil},
+		{"set", time.Minute, time.Minute, nil},
+		{"negative", -time.Second, 0, ErrNegativePurgeInterval},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := DefaultOptions()
+			opt.PurgeInterval = tt.interval
+			ing, err := Open(t.TempDir(), opt)
+			if err != tt.err {
+				t.Fatalf("Open() err: got = %v, want = %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			defer ing.Close(true)
+
+			if ing.opt.PurgeInterval != tt.want {
+				t.Errorf("PurgeInterval: got = %v, want = %v", ing.opt.PurgeInterval, tt.want)
+			}
+		})
+	}
+}
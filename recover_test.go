@@ -0,0 +1,213 @@
+package ingens
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyDir 复制数据库目录，模拟在此时崩溃
+func copyDir(t *testing.T, src, dst string) {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatalf("ReadDir() err: %v", err)
+	}
+	for _, e := range entries {
+		in, err := os.Open(filepath.Join(src, e.Name()))
+		if err != nil {
+			t.Fatalf("Open() err: %v", err)
+		}
+		out, err := os.Create(filepath.Join(dst, e.Name()))
+		if err != nil {
+			t.Fatalf("Create() err: %v", err)
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			t.Fatalf("Copy() err: %v", err)
+		}
+		in.Close()
+		out.Close()
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	path := t.TempDir()
+	opt := DefaultOptions()
+	opt.PurgeInterval = time.Hour // 由测试调用 purge
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%04d", i))
+	}
+
+	ing, err := Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	err = ing.Exec(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			if err := txn.Set(key(i), []byte("committed")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	// 未提交的事务修改、插入和删除 key，它的页面和回滚记录已经写回
+	txn, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := txn.Set(key(i), []byte("uncommitted")); err != nil {
+			t.Fatalf("Set() err: %v", err)
+		}
+	}
+	for i := 1; i < 100; i += 2 {
+		if err := txn.Delete(key(i)); err != nil {
+			t.Fatalf("Delete() err: %v", err)
+		}
+	}
+	for i := 100; i < 150; i++ {
+		if err := txn.Set(key(i), []byte("uncommitted")); err != nil {
+			t.Fatalf("Set() err: %v", err)
+		}
+	}
+	if err := ing.flush(); err != nil {
+		t.Fatalf("flush() err: %v", err)
+	}
+
+	crash := t.TempDir()
+	ing.metaMu.Lock()
+	copyDir(t, path, crash)
+	ing.metaMu.Unlock()
+
+	txn.Rollback()
+	ing.Close(true)
+
+	// 重启后回滚中断的事务
+	ing, err = Open(crash, opt)
+	if err != nil {
+		t.Fatalf("Open() after crash err: %v", err)
+	}
+	check := func(ing *Ingens) {
+		err := ing.View(func(txn *Txn) error {
+			for i := 0; i < 150; i++ {
+				got, err := txn.Get(key(i))
+				if i >= 100 {
+					if err != ErrNotFoundEntry {
+						return fmt.Errorf("key %d: got = %s, %v, want = %v", i, got, err, ErrNotFoundEntry)
+					}
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("key %d: %w", i, err)
+				}
+				if !bytes.Equal(got, []byte("committed")) {
+					return fmt.Errorf("key %d: got = %s, want = committed", i, got)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Get() err: %v", err)
+		}
+	}
+	check(ing)
+
+	// 中断的事务已经标记为回滚，回收可以越过它
+	if tids, err := ing.tmgr.Unfinished(); err != nil || len(tids) != 0 {
+		t.Errorf("Unfinished(): got = %v, %v, want empty", tids, err)
+	}
+	if err := ing.purge(); err != nil {
+		t.Errorf("purge() err: %v", err)
+	}
+	if err := ing.Close(true); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+
+	ing, err = Open(crash, opt)
+	if err != nil {
+		t.Fatalf("Open() again err: %v", err)
+	}
+	check(ing)
+	ing.Close(true)
+}
+
+func TestCrashEvictedBeforeUndoFlush(t *testing.T) {
+	const n = 2000
+	path := t.TempDir()
+	opt := DefaultOptions()
+	opt.BufferCapacity = 8
+	opt.PurgeInterval = time.Hour // 由测试调用 purge
+
+	ing, err := Open(path, opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	err = ing.Exec(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			if err := txn.Set(iterKey(i), []byte("old")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	txn, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+	if err := ing.flush(); err != nil {
+		t.Fatalf("flush() err: %v", err)
+	}
+
+	// 未提交的事务修改所有 key，缓冲池只有 8 个页面，修改过的叶子节点在 undo 写回之前被淘汰
+	pageNum := ing.pageNum
+	for i := 0; i < n; i++ {
+		if err := txn.Update(iterKey(i), []byte("new")); err != nil {
+			t.Fatalf("Update() err: %v", err)
+		}
+	}
+	if ing.pageNum != pageNum {
+		t.Fatalf("pageNum: got = %v, want = %v", ing.pageNum, pageNum)
+	}
+
+	crash := t.TempDir()
+	ing.metaMu.Lock()
+	copyDir(t, path, crash)
+	ing.metaMu.Unlock()
+
+	txn.Rollback()
+	ing.Close(true)
+
+	ing, err = Open(crash, opt)
+	if err != nil {
+		t.Fatalf("Open() after crash err: %v", err)
+	}
+	defer ing.Close(true)
+
+	err = ing.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			got, err := txn.Get(iterKey(i))
+			if err != nil {
+				return fmt.Errorf("key %d: %w", i, err)
+			}
+			if !bytes.Equal(got, []byte("old")) {
+				return fmt.Errorf("key %d: got = %s, want = old", i, got)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Get() err: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package ingens
+
+import (
+	"github/suixinpr/ingens/base"
+	"sync/atomic"
+	"time"
+)
+
+// Stats statistics of the database
+type Stats struct {
+	// transaction
+	ActiveSnapshots   int                       // 正在使用的快照数量
+	OldestSnapshotAge time.Duration             // 最早获取的快照已经使用的时间，用于发现长时间运行的读事务
+	OldestActiveCsn   base.CommitSequenceNumber // 正在使用的快照中最小的 csn，之前的旧版本不会再被读取
+
+	// purge
+	PurgeRuns          uint64                    // 完成的回收次数
+	PurgedEntries      uint64                    // 删除的 dead entry 数量
+	PurgedUndoSegments uint64                    // 删除的 undo 段数量
+	PurgeHorizon       base.CommitSequenceNumber // 最近一次回收的边界，之前提交的事务覆盖的旧版本可以删除
+	PurgeLag           uint64                    // 回收边界之后的提交数量，它们的旧版本仍然保留
+	LastPurge          time.Time                 // 最近一次完成回收的时间
+	PurgeErrors        uint64                    // 失败的回收次数，失败的回收在下一次重新执行
+	LastPurgeError     error                     // 最近一次回收失败的原因
+	UndoSegments       int                       // undo 段的数量
+	UndoSize           int64                     // undo 段占用的空间，与 Option.MaxUndoSize 比较
+}
+
+// Stats return the statistics of the database
+func (ing *Ingens) Stats() Stats {
+	var stats Stats
+
+	// transaction
+	n, start := ing.tmgr.ActiveSnapshots()
+	stats.ActiveSnapshots = n
+	if n > 0 {
+		stats.OldestSnapshotAge = time.Since(start)
+	}
+	stats.OldestActiveCsn = ing.tmgr.OldestActiveCsn()
+
+	// purge
+	stats.PurgeRuns = atomic.LoadUint64(&ing.purgeStats.runs)
+	stats.PurgedEntries = atomic.LoadUint64(&ing.purgeStats.entries)
+	stats.PurgedUndoSegments = atomic.LoadUint64(&ing.purgeStats.segments)
+	stats.PurgeHorizon = base.CommitSequenceNumber(atomic.LoadUint64(&ing.purgeStats.horizon))
+	stats.PurgeLag = uint64(ing.tmgr.LatestCsn() - stats.PurgeHorizon)
+	if last := atomic.LoadInt64(&ing.purgeStats.last); last != 0 {
+		stats.LastPurge = time.Unix(0, last)
+	}
+	stats.PurgeErrors = atomic.LoadUint64(&ing.purgeStats.errors)
+	if v, ok := ing.purgeStats.err.Load().(purgeError); ok {
+		stats.LastPurgeError = v.err
+	}
+	stats.UndoSegments = ing.umgr.Segments()
+	stats.UndoSize = ing.umgr.Size()
+
+	return stats
+}
@@ -1,9 +1,16 @@
 package ingens
 
 import (
+	"container/list"
+	"context"
+	"encoding/binary"
 	"errors"
 	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/locker"
+	"github/suixinpr/ingens/manager/transaction"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -12,18 +19,70 @@ var (
 
 	// ErrTxIsInvalid transcation is invalid
 	ErrTnxIsInvalid = errors.New("ingens: transcation is invalid")
+
+	// ErrTxnReadOnly write in a read-only transaction
+	ErrTxnReadOnly = errors.New("ingens: transcation is read-only")
+
+	// ErrSavepointNotFound the savepoint does not exist
+	ErrSavepointNotFound = errors.New("ingens: savepoint does not exist")
 )
 
+// TxnOptions options of a transaction, zero values fall back to Option
+type TxnOptions struct {
+	Isolation IsolationLevel
+	ReadOnly  bool          // 只读事务不分配 tid 也不加锁，写操作返回 ErrTxnReadOnly
+	Timeout   time.Duration // 等待 entry 锁的超时时间
+	Priority  int           // 可串行化事务冲突时优先回滚优先级低的事务
+}
+
+// savepoint 保存点，ptr 为设置时事务最后一条回滚记录
+type savepoint struct {
+	name string
+	ptr  base.UndoRecordPtr
+}
+
 type Txn struct {
 	ing *Ingens
+	ctx context.Context
 
 	mu sync.Mutex
 
-	tid      base.TransactionId
-	snapshot base.TransactionId
+	tid      base.TransactionId // 第一次写操作时分配
+	snapshot *transaction.Snapshot
+	sxact    *locker.SerializableTxn // 可串行化隔离级别下记录读写依赖
+
+	isolation IsolationLevel
+	readOnly  bool
+	timeout   time.Duration
 
+	savepoints []savepoint
+
+	start   time.Time
+	elem    *list.Element // Ingens.txns
 	closed  bool
-	invalid uint32
+	err     error         // ctx 结束导致回滚的原因，之后的操作返回它
+	invalid uint32        // 超出 Option.MaxTxnAge 或者 Option.MaxUndoSize 被回滚
+	done    chan struct{} // 事务结束时关闭
+}
+
+// check 检查事务是否还能执行操作，write 为 true 时还要求事务不是只读的
+func (txn *Txn) check(write bool) error {
+	if atomic.LoadUint32(&txn.invalid) == 1 {
+		return ErrSnapshotTooOld
+	}
+
+	if txn.closed {
+		return txn.closedErr()
+	}
+
+	if err := txn.ctx.Err(); err != nil {
+		return err
+	}
+
+	if write && txn.readOnly {
+		return ErrTxnReadOnly
+	}
+	return nil
 }
 
 // Get get the value of key
@@ -31,14 +90,14 @@ func (txn *Txn) Get(key []byte) ([]byte, error) {
 	txn.mu.Lock()
 	defer txn.mu.Unlock()
 
-	if txn.closed {
-		return nil, ErrTnxIsClosed
+	if err := txn.check(false); err != nil {
+		return nil, err
 	}
 
 	// key
 	ikey := key
 	if txn.ing.opt.Copy {
-		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
 		copy(ikey, key)
 		defer txn.ing.mmgr.Free(ikey)
 	}
@@ -49,7 +108,45 @@ func (txn *Txn) Get(key []byte) ([]byte, error) {
 	}
 
 	// get
-	return txn.ing.get(txn.snapshot, ikey)
+	txn.beginStatement()
+	return txn.ing.get(txn, ikey)
+}
+
+// MultiGet get the values of many keys with the same snapshot as Get
+// values[i] and errs[i] are the result of keys[i]
+func (txn *Txn) MultiGet(keys [][]byte) ([][]byte, []error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	if err := txn.check(false); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+
+	// keys
+	ikeys := keys
+	if txn.ing.opt.Copy {
+		ikeys = make([][]byte, len(keys))
+		for i, key := range keys {
+			ikeys[i] = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+			copy(ikeys[i], key)
+			defer txn.ing.mmgr.Free(ikeys[i])
+		}
+	}
+
+	// check if the keys are valid
+	for i, key := range ikeys {
+		errs[i] = txn.ing.opt.CheckKey(key)
+	}
+
+	// multi get
+	txn.beginStatement()
+	txn.ing.multiGet(txn, ikeys, values, errs)
+	return values, errs
 }
 
 // Setnx set key to hold the value
@@ -57,18 +154,18 @@ func (txn *Txn) Setnx(key, value []byte) (err error) {
 	txn.mu.Lock()
 	defer txn.mu.Unlock()
 
-	if txn.closed {
-		return ErrTnxIsClosed
+	if err := txn.check(true); err != nil {
+		return err
 	}
 
 	// key, value
 	ikey, ivalue := key, value
 	if txn.ing.opt.Copy {
-		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
 		copy(ikey, key)
 		defer txn.ing.mmgr.Free(ikey)
 
-		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))
+		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
 		copy(ivalue, value)
 		defer txn.ing.mmgr.Free(ivalue)
 	}
@@ -84,21 +181,237 @@ func (txn *Txn) Setnx(key, value []byte) (err error) {
 	}
 
 	// setnx
-	return txn.ing.setnx(ikey, ivalue)
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.setnx(txn, ikey, ivalue)
+}
+
+// Set set key to hold the value, the old value is overwritten if the key exists
+func (txn *Txn) Set(key, value []byte) (err error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return err
+	}
+
+	// key, value
+	ikey, ivalue := key, value
+	if txn.ing.opt.Copy {
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+		copy(ikey, key)
+		defer txn.ing.mmgr.Free(ikey)
+
+		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
+		copy(ivalue, value)
+		defer txn.ing.mmgr.Free(ivalue)
+	}
+
+	// check if the key is valid
+	if err := txn.ing.opt.CheckKey(ikey); err != nil {
+		return err
+	}
+
+	// check if the value is valid
+	if err := txn.ing.opt.CheckValue(ivalue); err != nil {
+		return err
+	}
+
+	// set
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.set(txn, ikey, ivalue)
+}
+
+// Update update the value of an existing key
+// ErrNotFoundEntry is returned if the key does not exist
+func (txn *Txn) Update(key, value []byte) (err error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return err
+	}
+
+	// key, value
+	ikey, ivalue := key, value
+	if txn.ing.opt.Copy {
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+		copy(ikey, key)
+		defer txn.ing.mmgr.Free(ikey)
+
+		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
+		copy(ivalue, value)
+		defer txn.ing.mmgr.Free(ivalue)
+	}
+
+	// check if the key is valid
+	if err := txn.ing.opt.CheckKey(ikey); err != nil {
+		return err
+	}
+
+	// check if the value is valid
+	if err := txn.ing.opt.CheckValue(ivalue); err != nil {
+		return err
+	}
+
+	// update
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.update(txn, ikey, ivalue)
+}
+
+// GetSet set key to hold the value and return its previous value
+// the previous value is nil if the key does not exist
+func (txn *Txn) GetSet(key, value []byte) ([]byte, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return nil, err
+	}
+
+	// key, value
+	ikey, ivalue := key, value
+	if txn.ing.opt.Copy {
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+		copy(ikey, key)
+		defer txn.ing.mmgr.Free(ikey)
+
+		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
+		copy(ivalue, value)
+		defer txn.ing.mmgr.Free(ivalue)
+	}
+
+	// check if the key is valid
+	if err := txn.ing.opt.CheckKey(ikey); err != nil {
+		return nil, err
+	}
+
+	// check if the value is valid
+	if err := txn.ing.opt.CheckValue(ivalue); err != nil {
+		return nil, err
+	}
+
+	// getset
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return nil, err
+	}
+	return txn.ing.getset(txn, ikey, ivalue)
+}
+
+// CompareAndSwap set key to hold the value if its current value equals expected
+// expected nil means the key must not exist. The returned bool reports
+// whether the value was swapped
+func (txn *Txn) CompareAndSwap(key, expected, value []byte) (bool, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return false, err
+	}
+
+	// key, expected, value
+	ikey, iexpected, ivalue := key, expected, value
+	if txn.ing.opt.Copy {
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+		copy(ikey, key)
+		defer txn.ing.mmgr.Free(ikey)
+
+		if expected != nil {
+			iexpected = txn.ing.mmgr.Alloc(uint32(len(expected)))[:len(expected)]
+			copy(iexpected, expected)
+			defer txn.ing.mmgr.Free(iexpected)
+		}
+
+		ivalue = txn.ing.mmgr.Alloc(uint32(len(value)))[:len(value)]
+		copy(ivalue, value)
+		defer txn.ing.mmgr.Free(ivalue)
+	}
+
+	// check if the key is valid
+	if err := txn.ing.opt.CheckKey(ikey); err != nil {
+		return false, err
+	}
+
+	// check if the value is valid
+	if err := txn.ing.opt.CheckValue(ivalue); err != nil {
+		return false, err
+	}
+
+	// compare and swap
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return false, err
+	}
+	return txn.ing.compareAndSwap(txn, ikey, iexpected, ivalue)
+}
+
+// IncrBy add delta to the integer held by key and return the new value
+// a missing key is treated as 0, the value is encoded by EncodeInt64
+func (txn *Txn) IncrBy(key []byte, delta int64) (int64, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return 0, err
+	}
+
+	// key
+	ikey := key
+	if txn.ing.opt.Copy {
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
+		copy(ikey, key)
+		defer txn.ing.mmgr.Free(ikey)
+	}
+
+	// check if the key is valid
+	if err := txn.ing.opt.CheckKey(ikey); err != nil {
+		return 0, err
+	}
+
+	// incr by
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return 0, err
+	}
+	return txn.ing.incrBy(txn, ikey, delta)
+}
+
+// EncodeInt64 encode v as an 8-byte big-endian value, the format used by IncrBy
+func EncodeInt64(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+// DecodeInt64 decode a value written by EncodeInt64
+func DecodeInt64(buf []byte) (int64, error) {
+	if len(buf) != 8 {
+		return 0, ErrValueNotInteger
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
 }
 
 func (txn *Txn) Delete(key []byte) (err error) {
 	txn.mu.Lock()
 	defer txn.mu.Unlock()
 
-	if txn.closed {
-		return ErrTnxIsClosed
+	if err := txn.check(true); err != nil {
+		return err
 	}
 
 	// key
 	ikey := key
 	if txn.ing.opt.Copy {
-		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))
+		ikey = txn.ing.mmgr.Alloc(uint32(len(key)))[:len(key)]
 		copy(ikey, key)
 		defer txn.ing.mmgr.Free(ikey)
 	}
@@ -108,30 +421,290 @@ func (txn *Txn) Delete(key []byte) (err error) {
 		return err
 	}
 
-	return txn.ing.delete(txn.tid, ikey)
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.delete(txn, ikey)
 }
 
+// DeleteRange delete all keys in [start, end)
+// end is exclusive, nil means deleting all keys from start
+func (txn *Txn) DeleteRange(start, end []byte) (err error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(true); err != nil {
+		return err
+	}
+
+	// start, end
+	istart, iend := start, end
+	if txn.ing.opt.Copy {
+		istart = txn.ing.mmgr.Alloc(uint32(len(start)))[:len(start)]
+		copy(istart, start)
+		defer txn.ing.mmgr.Free(istart)
+
+		if end != nil {
+			iend = txn.ing.mmgr.Alloc(uint32(len(end)))[:len(end)]
+			copy(iend, end)
+			defer txn.ing.mmgr.Free(iend)
+		}
+	}
+
+	// check if the keys are valid
+	if err := txn.ing.opt.CheckKey(istart); err != nil {
+		return err
+	}
+	if iend != nil {
+		if err := txn.ing.opt.CheckKey(iend); err != nil {
+			return err
+		}
+	}
+
+	txn.beginStatement()
+	if err := txn.assignTid(); err != nil {
+		return err
+	}
+	return txn.ing.deleteRange(txn, istart, iend)
+}
+
+// Commit commit the transaction, its writes are visible to
+// snapshots taken afterwards
 func (txn *Txn) Commit() error {
 	txn.mu.Lock()
 	defer txn.mu.Unlock()
 
+	if atomic.LoadUint32(&txn.invalid) == 1 {
+		return ErrSnapshotTooOld
+	}
+
 	if txn.closed {
-		return ErrTnxIsClosed
+		return txn.closedErr()
+	}
+
+	// 请求已经取消，回滚
+	if err := txn.ctx.Err(); err != nil {
+		txn.err = err
+		txn.abort()
+		return err
+	}
+
+	// 提交可能破坏可串行化，回滚
+	if txn.sxact != nil && !txn.ing.rmgr.PreCommit(txn.sxact) {
+		txn.abort()
+		return ErrSerializationFailure
+	}
+
+	// 只读事务没有分配 tid，只需要归还快照
+	var csn base.CommitSequenceNumber
+	if txn.tid == base.InvalidTid {
+		csn = txn.ing.tmgr.LatestCsn()
+		txn.ing.tmgr.ReleaseSnapshot(txn.snapshot)
+	} else {
+		csn = txn.ing.tmgr.FinishTransaction(txn.tid, txn.snapshot)
+		txn.ing.umgr.FinishTransaction(txn.tid)
 	}
 
+	if txn.sxact != nil {
+		txn.ing.rmgr.Commit(txn.sxact, csn)
+	}
+
+	txn.finish()
 	return nil
 }
 
+// Rollback undo all writes of the transaction
 func (txn *Txn) Rollback() error {
 	txn.mu.Lock()
 	defer txn.mu.Unlock()
 
+	if atomic.LoadUint32(&txn.invalid) == 1 {
+		return ErrSnapshotTooOld
+	}
+
 	if txn.closed {
 		return ErrTnxIsClosed
 	}
 
-	// pop UndoRecord
-	// exec
+	return txn.abort()
+}
+
+// Savepoint set a savepoint, RollbackTo(name) undoes the writes after it
+// a savepoint with the same name hides the earlier one
+func (txn *Txn) Savepoint(name string) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(false); err != nil {
+		return err
+	}
+
+	// 记录当前回滚记录的位置，还没有写入时为 InvalidUndoRecordPtr
+	ptr := base.InvalidUndoRecordPtr
+	if txn.tid != base.InvalidTid {
+		ptr = txn.ing.umgr.LastUndoRecordPtr(txn.tid)
+	}
+
+	txn.savepoints = append(txn.savepoints, savepoint{name: name, ptr: ptr})
+	return nil
+}
+
+// RollbackTo undo the writes after the savepoint, the transaction stays open
+// the savepoint is kept and the savepoints set after it are released
+func (txn *Txn) RollbackTo(name string) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(false); err != nil {
+		return err
+	}
+
+	i := txn.findSavepoint(name)
+	if i < 0 {
+		return ErrSavepointNotFound
+	}
+	txn.savepoints = txn.savepoints[:i+1]
+
+	if txn.tid == base.InvalidTid {
+		return nil
+	}
+	return txn.ing.rollback(txn.tid, txn.savepoints[i].ptr)
+}
+
+// ReleaseSavepoint release the savepoint and the savepoints set after it,
+// the writes after it are kept
+func (txn *Txn) ReleaseSavepoint(name string) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.check(false); err != nil {
+		return err
+	}
+
+	i := txn.findSavepoint(name)
+	if i < 0 {
+		return ErrSavepointNotFound
+	}
+	txn.savepoints = txn.savepoints[:i]
+	return nil
+}
+
+// findSavepoint 返回最后一个名为 name 的保存点，不存在时返回 -1
+func (txn *Txn) findSavepoint(name string) int {
+	for i := len(txn.savepoints) - 1; i >= 0; i-- {
+		if txn.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// watch ctx 结束时回滚仍未结束的事务，释放事务持有的资源
+func (txn *Txn) watch() {
+	select {
+	case <-txn.ctx.Done():
+		txn.mu.Lock()
+		if !txn.closed {
+			txn.err = txn.ctx.Err()
+			txn.abort()
+		}
+		txn.mu.Unlock()
+	case <-txn.done:
+	}
+}
+
+// closedErr 事务因为 ctx 结束被回滚时返回 ctx 的错误，否则返回 ErrTnxIsClosed
+func (txn *Txn) closedErr() error {
+	if txn.err != nil {
+		return txn.err
+	}
+	return ErrTnxIsClosed
+}
+
+// kill 回滚运行时间过长的事务，之后的操作返回 ErrSnapshotTooOld
+func (txn *Txn) kill() {
+	if !atomic.CompareAndSwapUint32(&txn.invalid, 0, 1) {
+		return
+	}
+
+	txn.mu.Lock()
+	if !txn.closed {
+		txn.abort()
+	}
+	txn.mu.Unlock()
+}
+
+// run 执行fn，fn返回nil时提交，否则回滚
+// fn panic时回滚事务后继续panic
+func (txn *Txn) run(fn func(*Txn) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			txn.Rollback()
+			panic(r)
+		}
+	}()
 
+	if err = fn(txn); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// abort 回滚事务的所有修改并关闭事务
+func (txn *Txn) abort() (err error) {
+	if txn.tid == base.InvalidTid {
+		txn.ing.tmgr.ReleaseSnapshot(txn.snapshot)
+	} else {
+		// 逆序执行回滚记录，回滚失败时事务保持未结束，回收不会越过该事务
+		err = txn.ing.rollback(txn.tid, base.InvalidUndoRecordPtr)
+		if err == nil {
+			txn.ing.tmgr.AbortTransaction(txn.tid, txn.snapshot)
+		} else {
+			txn.ing.tmgr.ReleaseSnapshot(txn.snapshot)
+		}
+	}
+
+	if txn.sxact != nil {
+		txn.ing.rmgr.Abort(txn.sxact)
+	}
+
+	txn.finish()
+	return err
+}
+
+// beginStatement 读已提交隔离级别下每条语句使用新的快照
+func (txn *Txn) beginStatement() {
+	if txn.isolation == ReadCommitted {
+		txn.ing.tmgr.ReleaseSnapshot(txn.snapshot)
+		txn.snapshot = txn.ing.tmgr.GetSnapshot()
+	}
+}
+
+// assignTid 在第一次写操作时为事务分配 tid
+func (txn *Txn) assignTid() error {
+	if txn.tid == base.InvalidTid {
+		tid, err := txn.ing.getTransactionId()
+		if err != nil {
+			return err
+		}
+		txn.tid = tid
+		if txn.sxact != nil {
+			txn.ing.rmgr.SetTid(txn.sxact, txn.tid)
+		}
+	}
 	return nil
 }
+
+// finish 关闭事务，释放持有的资源
+func (txn *Txn) finish() {
+	txn.closed = true
+	txn.snapshot = nil
+	txn.savepoints = nil
+	close(txn.done)
+	txn.sxact = nil
+	txn.ing.unregisterTxn(txn)
+	txn.ing.closeT.Done()
+}
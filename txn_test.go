@@ -0,0 +1,921 @@
+package ingens
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T, opt Option) *Ingens {
+	ing, err := Open(t.TempDir(), opt)
+	if err != nil {
+		t.Fatalf("Open() err: %v", err)
+	}
+	return ing
+}
+
+func TestTxnContext(t *testing.T) {
+	test := []struct {
+		name string
+
+		ctx  func() (context.Context, context.CancelFunc)
+		wait bool // 等待 ctx 结束后的回滚完成
+		want error
+	}{
+		{"cancel", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, true, context.Canceled},
+		{"cancel before commit", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, false, context.Canceled},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 10*time.Millisecond)
+		}, true, context.DeadlineExceeded},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			txn, err := ing.BeginTxContext(ctx, TxnOptions{})
+			if err != nil {
+				t.Fatalf("BeginTxContext() err: %v", err)
+			}
+			if err := txn.Set([]byte("key"), []byte("value")); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			if tt.want == context.Canceled {
+				cancel()
+			}
+			if tt.wait {
+				<-txn.done
+			}
+
+			// 回滚后的操作返回 ctx 的错误而不是 ErrTnxIsClosed
+			if _, err := txn.Get([]byte("key")); err != tt.want {
+				t.Errorf("Get() err: got = %v, want = %v", err, tt.want)
+			}
+			if err := txn.Commit(); err != tt.want {
+				t.Errorf("Commit() err: got = %v, want = %v", err, tt.want)
+			}
+			if err := txn.Commit(); err != tt.want {
+				t.Errorf("Commit() again err: got = %v, want = %v", err, tt.want)
+			}
+
+			err = ing.View(func(txn *Txn) error {
+				_, err := txn.Get([]byte("key"))
+				return err
+			})
+			if err != ErrNotFoundEntry {
+				t.Errorf("View() err: got = %v, want = %v", err, ErrNotFoundEntry)
+			}
+		})
+	}
+}
+
+func TestCommit(t *testing.T) {
+	test := []struct {
+		name string
+
+		fn   func(txn *Txn) error
+		want map[string]string // 提交后 key 的值，"" 表示不存在
+	}{
+		{"set", func(txn *Txn) error {
+			return txn.Set([]byte("new"), []byte("1"))
+		}, map[string]string{"new": "1", "old": "0"}},
+		{"overwrite", func(txn *Txn) error {
+			return txn.Set([]byte("old"), []byte("1"))
+		}, map[string]string{"old": "1"}},
+		{"delete", func(txn *Txn) error {
+			return txn.Delete([]byte("old"))
+		}, map[string]string{"old": ""}},
+		{"read only", func(txn *Txn) error {
+			_, err := txn.Get([]byte("old"))
+			return err
+		}, map[string]string{"old": "0"}},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			ing, err := Open(path, DefaultOptions())
+			if err != nil {
+				t.Fatalf("Open() err: %v", err)
+			}
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("old"), []byte("0")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			if err := tt.fn(txn); err != nil {
+				t.Fatalf("fn() err: %v", err)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("Commit() err: %v", err)
+			}
+			if err := txn.Commit(); err != ErrTnxIsClosed {
+				t.Errorf("Commit() again err: got = %v, want = %v", err, ErrTnxIsClosed)
+			}
+
+			// 提交的修改在重启后仍然可见
+			check := func(ing *Ingens) {
+				t.Helper()
+				if err := checkValues(ing, tt.want); err != nil {
+					t.Error(err)
+				}
+			}
+			check(ing)
+			if err := ing.Close(true); err != nil {
+				t.Fatalf("Close() err: %v", err)
+			}
+
+			ing, err = Open(path, DefaultOptions())
+			if err != nil {
+				t.Fatalf("Open() again err: %v", err)
+			}
+			defer ing.Close(true)
+			check(ing)
+		})
+	}
+}
+
+// checkValues 检查 key 的最新值，"" 表示 key 不存在
+func checkValues(ing *Ingens, want map[string]string) error {
+	return ing.View(func(txn *Txn) error {
+		for key, value := range want {
+			got, err := txn.Get([]byte(key))
+			if value == "" {
+				if err != ErrNotFoundEntry {
+					return fmt.Errorf("Get(%s): got = %s, %v, want = %v", key, got, err, ErrNotFoundEntry)
+				}
+				continue
+			}
+			if err != nil || string(got) != value {
+				return fmt.Errorf("Get(%s): got = %s, %v, want = %s", key, got, err, value)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRollback(t *testing.T) {
+	test := []struct {
+		name string
+
+		fn func(txn *Txn) error
+	}{
+		{"insert", func(txn *Txn) error {
+			return txn.Set([]byte("c"), []byte("1"))
+		}},
+		{"overwrite", func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("1"))
+		}},
+		{"overwrite twice", func(txn *Txn) error {
+			if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+				return err
+			}
+			return txn.Update([]byte("a"), []byte("2"))
+		}},
+		{"delete", func(txn *Txn) error {
+			return txn.Delete([]byte("b"))
+		}},
+		{"delete and insert", func(txn *Txn) error {
+			if err := txn.Delete([]byte("b")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("b"), []byte("1"))
+		}},
+		{"split", func(txn *Txn) error {
+			for i := 0; i < 200; i++ {
+				if err := txn.Set(iterKey(i), []byte("1")); err != nil {
+					return err
+				}
+			}
+			return txn.Set([]byte("a"), []byte("1"))
+		}},
+	}
+
+	want := map[string]string{"a": "0", "b": "0", "c": ""}
+	for i := 0; i < 200; i++ {
+		want[string(iterKey(i))] = ""
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			err := ing.Exec(func(txn *Txn) error {
+				if err := txn.Set([]byte("a"), []byte("0")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("b"), []byte("0"))
+			})
+			if err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			if err := tt.fn(txn); err != nil {
+				t.Fatalf("fn() err: %v", err)
+			}
+			if err := txn.Rollback(); err != nil {
+				t.Fatalf("Rollback() err: %v", err)
+			}
+			if err := txn.Rollback(); err != ErrTnxIsClosed {
+				t.Errorf("Rollback() again err: got = %v, want = %v", err, ErrTnxIsClosed)
+			}
+
+			// 回滚后恢复原有的值，新的事务可以修改同样的 key
+			if err := checkValues(ing, want); err != nil {
+				t.Error(err)
+			}
+			if err := ing.Exec(tt.fn); err != nil {
+				t.Errorf("fn() after rollback err: %v", err)
+			}
+		})
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	// sets 依次写入 key=value，value 为 "" 时删除 key
+	sets := func(txn *Txn, kvs ...string) error {
+		for i := 0; i < len(kvs); i += 2 {
+			var err error
+			if kvs[i+1] == "" {
+				err = txn.Delete([]byte(kvs[i]))
+			} else {
+				err = txn.Set([]byte(kvs[i]), []byte(kvs[i+1]))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rollbackTo := func(txn *Txn, name string, want error) error {
+		if err := txn.RollbackTo(name); err != want {
+			return fmt.Errorf("RollbackTo(%s) err: got = %v, want = %v", name, err, want)
+		}
+		return nil
+	}
+
+	test := []struct {
+		name string
+
+		fn   func(txn *Txn) error
+		want map[string]string // 提交后 key 的值，"" 表示不存在
+	}{
+		{"rollback to", func(txn *Txn) error {
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "2", "b", "", "c", "1"); err != nil {
+				return err
+			}
+			return rollbackTo(txn, "s", nil)
+		}, map[string]string{"a": "1", "b": "0", "c": ""}},
+		{"before first write", func(txn *Txn) error {
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "1", "c", "1"); err != nil {
+				return err
+			}
+			return rollbackTo(txn, "s", nil)
+		}, map[string]string{"a": "0", "b": "0", "c": ""}},
+		{"rollback twice", func(txn *Txn) error {
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := rollbackTo(txn, "s", nil); err != nil {
+				return err
+			}
+			// 保存点仍然存在，回滚后可以再次写入同一个 key
+			if err := sets(txn, "a", "2", "b", "2"); err != nil {
+				return err
+			}
+			if err := rollbackTo(txn, "s", nil); err != nil {
+				return err
+			}
+			return sets(txn, "b", "3")
+		}, map[string]string{"a": "0", "b": "3"}},
+		{"nested", func(txn *Txn) error {
+			if err := txn.Savepoint("s1"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s2"); err != nil {
+				return err
+			}
+			if err := sets(txn, "b", ""); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s3"); err != nil {
+				return err
+			}
+			if err := sets(txn, "c", "1", "a", "3"); err != nil {
+				return err
+			}
+			// 回滚到 s2 同时释放 s3
+			if err := rollbackTo(txn, "s2", nil); err != nil {
+				return err
+			}
+			if err := rollbackTo(txn, "s3", ErrSavepointNotFound); err != nil {
+				return err
+			}
+			if err := sets(txn, "c", "2"); err != nil {
+				return err
+			}
+			return rollbackTo(txn, "s1", nil)
+		}, map[string]string{"a": "0", "b": "0", "c": ""}},
+		{"same name", func(txn *Txn) error {
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			if err := sets(txn, "b", "1"); err != nil {
+				return err
+			}
+			return rollbackTo(txn, "s", nil)
+		}, map[string]string{"a": "1", "b": "0"}},
+		{"release", func(txn *Txn) error {
+			if err := txn.Savepoint("s1"); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s2"); err != nil {
+				return err
+			}
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := txn.ReleaseSavepoint("s1"); err != nil {
+				return err
+			}
+			if err := txn.ReleaseSavepoint("s1"); err != ErrSavepointNotFound {
+				return fmt.Errorf("ReleaseSavepoint() again err: got = %v, want = %v", err, ErrSavepointNotFound)
+			}
+			return rollbackTo(txn, "s2", ErrSavepointNotFound)
+		}, map[string]string{"a": "1", "b": "0"}},
+		{"split", func(txn *Txn) error {
+			if err := sets(txn, "a", "1"); err != nil {
+				return err
+			}
+			if err := txn.Savepoint("s"); err != nil {
+				return err
+			}
+			// 插入的 key 拆分叶子节点，回滚需要在拆分后的节点中找到它们
+			for i := 0; i < 200; i++ {
+				if err := txn.Set(iterKey(i), []byte("1")); err != nil {
+					return err
+				}
+			}
+			if err := sets(txn, "b", "1"); err != nil {
+				return err
+			}
+			if err := rollbackTo(txn, "s", nil); err != nil {
+				return err
+			}
+			return txn.Set(iterKey(100), []byte("2"))
+		}, map[string]string{"a": "1", "b": "0", string(iterKey(0)): "", string(iterKey(100)): "2", string(iterKey(199)): ""}},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			if err := ing.Exec(func(txn *Txn) error { return sets(txn, "a", "0", "b", "0") }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			if err := tt.fn(txn); err != nil {
+				txn.Rollback()
+				t.Fatalf("fn() err: %v", err)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("Commit() err: %v", err)
+			}
+			if err := txn.RollbackTo("s"); err != ErrTnxIsClosed {
+				t.Errorf("RollbackTo() after commit err: got = %v, want = %v", err, ErrTnxIsClosed)
+			}
+
+			if err := checkValues(ing, tt.want); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExecRetry(t *testing.T) {
+	errOther := errors.New("other error")
+
+	test := []struct {
+		name string
+
+		fail     int   // 前 fail 次执行返回 err
+		err      error // fn 返回的错误
+		attempts int
+		want     error
+	}{
+		{"success", 0, nil, 1, nil},
+		{"write conflict", 2, ErrWriteConflict, 3, nil},
+		{"lock timeout", 1, ErrLockEntryTimeout, 2, nil},
+		{"wrapped serialization failure", 3, fmt.Errorf("wrapped: %w", ErrSerializationFailure), 4, nil},
+		{"exhausted", 10, ErrWriteConflict, 4, ErrWriteConflict},
+		{"not retryable", 10, errOther, 1, errOther},
+	}
+
+	opt := DefaultOptions()
+	opt.RetryTimes = 3
+	opt.RetryBackoff = time.Millisecond
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, opt)
+			defer ing.Close(true)
+
+			// 每次执行写入执行的次数，失败的执行被回滚
+			attempts := 0
+			err := ing.Exec(func(txn *Txn) error {
+				attempts++
+				if err := txn.Set([]byte("key"), []byte(fmt.Sprint(attempts))); err != nil {
+					return err
+				}
+				if attempts <= tt.fail {
+					return tt.err
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Exec() err: got = %v, want = %v", err, tt.want)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("Exec() attempts: got = %v, want = %v", attempts, tt.attempts)
+			}
+
+			want := ""
+			if tt.want == nil {
+				want = fmt.Sprint(tt.attempts)
+			}
+			if err := checkValues(ing, map[string]string{"key": want}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExecPanic(t *testing.T) {
+	ing := openTest(t, DefaultOptions())
+	defer ing.Close(true)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recover(): got = %v, want = boom", r)
+			}
+		}()
+		ing.Exec(func(txn *Txn) error {
+			if err := txn.Set([]byte("key"), []byte("value")); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+
+	// panic 时事务已经回滚，锁已经释放
+	if err := checkValues(ing, map[string]string{"key": ""}); err != nil {
+		t.Error(err)
+	}
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("key"), []byte("value")) }); err != nil {
+		t.Errorf("Set() after panic err: %v", err)
+	}
+
+	// View 中的写操作返回 ErrTxnReadOnly，不重试
+	attempts := 0
+	err := ing.View(func(txn *Txn) error {
+		attempts++
+		return txn.Set([]byte("key"), []byte("view"))
+	})
+	if err != ErrTxnReadOnly || attempts != 1 {
+		t.Errorf("View() err: got = %v, %v attempts, want = %v, 1 attempt", err, attempts, ErrTxnReadOnly)
+	}
+}
+
+func TestUpdateGetSet(t *testing.T) {
+	test := []struct {
+		name string
+
+		key  string
+		fn   func(txn *Txn, key []byte) ([]byte, error)
+		prev []byte // GetSet 返回的旧值
+		err  error
+		want string // 提交后 key 的值，"" 表示不存在
+	}{
+		{"update existing", "old", func(txn *Txn, key []byte) ([]byte, error) {
+			return nil, txn.Update(key, []byte("1"))
+		}, nil, nil, "1"},
+		{"update missing", "missing", func(txn *Txn, key []byte) ([]byte, error) {
+			return nil, txn.Update(key, []byte("1"))
+		}, nil, ErrNotFoundEntry, ""},
+		{"update deleted", "old", func(txn *Txn, key []byte) ([]byte, error) {
+			if err := txn.Delete(key); err != nil {
+				return nil, err
+			}
+			return nil, txn.Update(key, []byte("1"))
+		}, nil, ErrNotFoundEntry, ""},
+		{"getset existing", "old", func(txn *Txn, key []byte) ([]byte, error) {
+			return txn.GetSet(key, []byte("1"))
+		}, []byte("0"), nil, "1"},
+		{"getset missing", "missing", func(txn *Txn, key []byte) ([]byte, error) {
+			return txn.GetSet(key, []byte("1"))
+		}, nil, nil, "1"},
+		{"getset twice", "old", func(txn *Txn, key []byte) ([]byte, error) {
+			if _, err := txn.GetSet(key, []byte("1")); err != nil {
+				return nil, err
+			}
+			return txn.GetSet(key, []byte("2"))
+		}, []byte("1"), nil, "2"},
+		{"getset nil value", "old", func(txn *Txn, key []byte) ([]byte, error) {
+			return txn.GetSet(key, nil)
+		}, nil, ErrValueEmpty, "0"},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			if err := ing.Exec(func(txn *Txn) error { return txn.Set([]byte("old"), []byte("0")) }); err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			prev, err := tt.fn(txn, []byte(tt.key))
+			if err != tt.err {
+				t.Errorf("fn() err: got = %v, want = %v", err, tt.err)
+			}
+			if !bytes.Equal(prev, tt.prev) || (prev == nil) != (tt.prev == nil) {
+				t.Errorf("GetSet() prev: got = %q, want = %q", prev, tt.prev)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("Commit() err: %v", err)
+			}
+
+			if err := checkValues(ing, map[string]string{tt.key: tt.want}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	test := []struct {
+		name string
+
+		start, end string // end 为 "" 表示没有上界
+		want       []string
+	}{
+		{"middle", "b", "d", []string{"a", "d", "e"}},
+		{"start missing", "bb", "d", []string{"a", "b", "d", "e"}},
+		{"unbounded", "c", "", []string{"a", "b"}},
+		{"all", "a", "", nil},
+		{"empty", "x", "z", []string{"a", "b", "c", "d", "e"}},
+		{"end before start", "d", "b", []string{"a", "b", "c", "d", "e"}},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			err := ing.Exec(func(txn *Txn) error {
+				for _, k := range []string{"a", "b", "c", "d", "e"} {
+					if err := txn.Set([]byte(k), []byte(k)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			var end []byte
+			if tt.end != "" {
+				end = []byte(tt.end)
+			}
+			deleteRange := func(txn *Txn) error { return txn.DeleteRange([]byte(tt.start), end) }
+
+			// 回滚后恢复所有 key
+			txn, err := ing.Begin()
+			if err != nil {
+				t.Fatalf("Begin() err: %v", err)
+			}
+			if err := deleteRange(txn); err != nil {
+				t.Fatalf("DeleteRange() err: %v", err)
+			}
+			txn.Rollback()
+			if got := scanKeys(t, ing); len(got) != 5 {
+				t.Errorf("keys after rollback: got = %q", got)
+			}
+
+			// 提交后再次删除同一范围不影响结果
+			for i := 0; i < 2; i++ {
+				if err := ing.Exec(deleteRange); err != nil {
+					t.Fatalf("DeleteRange() err: %v", err)
+				}
+				if got := scanKeys(t, ing); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("keys: got = %q, want = %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteRangeSplit(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	// 删除的范围跨越多个叶子节点
+	if err := ing.Exec(func(txn *Txn) error { return txn.DeleteRange(iterKey(51), iterKey(351)) }); err != nil {
+		t.Fatalf("DeleteRange() err: %v", err)
+	}
+
+	err := ing.View(func(txn *Txn) error {
+		want := 0
+		for it := txn.ScanPrefix(nil); it.Valid(); it.Next() {
+			if !bytes.Equal(it.Key(), iterKey(want)) {
+				return fmt.Errorf("Key(): got = %.8s, want = %.8s", it.Key(), iterKey(want))
+			}
+			if want += 2; want == 52 {
+				want = 352
+			}
+		}
+		if want != n {
+			return fmt.Errorf("last key: got = %v, want = %v", want-2, n-2)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteRangeSerializable(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Isolation = Serializable
+	ing := openTest(t, opt)
+	defer ing.Close(true)
+
+	t1, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+	t2, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+
+	// t1 删除空的范围并写入 flag，t2 读取 flag 并在 t1 删除的范围内插入 key
+	// t1 -> t2 -> t1 构成环，两个事务不能都提交
+	if err := t1.DeleteRange([]byte("a"), []byte("c")); err != nil {
+		t.Fatalf("DeleteRange() err: %v", err)
+	}
+	if err := t1.Set([]byte("flag"), []byte("1")); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+	if _, err := t2.Get([]byte("flag")); err != ErrNotFoundEntry {
+		t.Fatalf("Get() err: got = %v, want = %v", err, ErrNotFoundEntry)
+	}
+	if err := t2.Set([]byte("b"), []byte("1")); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	err1, err2 := t1.Commit(), t2.Commit()
+	if err1 != ErrSerializationFailure && err2 != ErrSerializationFailure {
+		t.Errorf("Commit() err: got = %v, %v, want = %v", err1, err2, ErrSerializationFailure)
+	}
+}
+
+// scanKeys 返回所有可见的 key
+func scanKeys(t *testing.T, ing *Ingens) []string {
+	var keys []string
+	err := ing.View(func(txn *Txn) error {
+		for it := txn.ScanPrefix(nil); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View() err: %v", err)
+	}
+	return keys
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	test := []struct {
+		name string
+
+		key      string
+		expected []byte
+		swapped  bool
+		want     string // 之后 key 的值，"" 表示不存在
+	}{
+		{"equal", "old", []byte("0"), true, "1"},
+		{"not equal", "old", []byte("2"), false, "0"},
+		{"empty expected", "old", []byte{}, false, "0"},
+		{"nil expected on existing", "old", nil, false, "0"},
+		{"nil expected on missing", "missing", nil, true, "1"},
+		{"nil expected on deleted", "deleted", nil, true, "1"},
+		{"expected on missing", "missing", []byte("0"), false, ""},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			err := ing.Exec(func(txn *Txn) error {
+				if err := txn.Set([]byte("old"), []byte("0")); err != nil {
+					return err
+				}
+				if err := txn.Set([]byte("deleted"), []byte("0")); err != nil {
+					return err
+				}
+				return txn.Delete([]byte("deleted"))
+			})
+			if err != nil {
+				t.Fatalf("Set() err: %v", err)
+			}
+
+			err = ing.Exec(func(txn *Txn) error {
+				swapped, err := txn.CompareAndSwap([]byte(tt.key), tt.expected, []byte("1"))
+				if err != nil {
+					return err
+				}
+				if swapped != tt.swapped {
+					t.Errorf("CompareAndSwap(): got = %v, want = %v", swapped, tt.swapped)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("CompareAndSwap() err: %v", err)
+			}
+			if err := checkValues(ing, map[string]string{tt.key: tt.want}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	test := []struct {
+		name string
+
+		init  []byte // nil 表示 key 不存在
+		delta int64
+		n     int64
+		err   error
+	}{
+		{"missing", nil, 5, 5, nil},
+		{"add", EncodeInt64(10), 5, 15, nil},
+		{"sub", EncodeInt64(10), -15, -5, nil},
+		{"max", EncodeInt64(math.MaxInt64 - 1), 1, math.MaxInt64, nil},
+		{"overflow", EncodeInt64(math.MaxInt64), 1, 0, ErrIntegerOverflow},
+		{"underflow", EncodeInt64(math.MinInt64), -1, 0, ErrIntegerOverflow},
+		{"not integer", []byte("abc"), 1, 0, ErrValueNotInteger},
+	}
+
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := openTest(t, DefaultOptions())
+			defer ing.Close(true)
+
+			key := []byte("counter")
+			if tt.init != nil {
+				if err := ing.Exec(func(txn *Txn) error { return txn.Set(key, tt.init) }); err != nil {
+					t.Fatalf("Set() err: %v", err)
+				}
+			}
+
+			err := ing.Exec(func(txn *Txn) error {
+				n, err := txn.IncrBy(key, tt.delta)
+				if n != tt.n || err != tt.err {
+					t.Errorf("IncrBy(): got = %v, %v, want = %v, %v", n, err, tt.n, tt.err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Exec() err: %v", err)
+			}
+
+			// 失败时保留原有的值
+			want := string(tt.init)
+			if tt.err == nil {
+				want = string(EncodeInt64(tt.n))
+			}
+			if err := checkValues(ing, map[string]string{string(key): want}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	const n = 400
+	ing := openIterTest(t, n)
+	defer ing.Close(true)
+
+	if err := ing.Exec(func(txn *Txn) error { return txn.Delete(iterKey(10)) }); err != nil {
+		t.Fatalf("Delete() err: %v", err)
+	}
+
+	txn, err := ing.Begin()
+	if err != nil {
+		t.Fatalf("Begin() err: %v", err)
+	}
+	defer txn.Rollback()
+	if err := txn.Set(iterKey(3), []byte("own")); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	// 之后提交的修改对事务的快照不可见
+	if err := ing.Exec(func(txn *Txn) error { return txn.Set(iterKey(200), []byte("new")) }); err != nil {
+		t.Fatalf("Set() err: %v", err)
+	}
+
+	test := []struct {
+		key   []byte
+		value string
+		err   error
+	}{
+		{iterKey(398), "398", nil},
+		{iterKey(0), "0", nil},
+		{iterKey(1), "", ErrNotFoundEntry},
+		{iterKey(10), "", ErrNotFoundEntry},
+		{iterKey(3), "own", nil},
+		{iterKey(200), "200", nil},
+		{nil, "", ErrKeyEmpty},
+		{iterKey(0), "0", nil},
+		{iterKey(n), "", ErrNotFoundEntry},
+	}
+
+	keys := make([][]byte, len(test))
+	for i, tt := range test {
+		keys[i] = tt.key
+	}
+	values, errs := txn.MultiGet(keys)
+	if len(values) != len(test) || len(errs) != len(test) {
+		t.Fatalf("MultiGet() len: got = %v, %v, want = %v", len(values), len(errs), len(test))
+	}
+	for i, tt := range test {
+		if errs[i] != tt.err || string(values[i]) != tt.value {
+			t.Errorf("MultiGet() %.8s: got = %q, %v, want = %q, %v", tt.key, values[i], errs[i], tt.value, tt.err)
+		}
+	}
+
+	// 与 Get 的结果相同
+	for i, tt := range test {
+		value, err := txn.Get(tt.key)
+		if err != errs[i] || !bytes.Equal(value, values[i]) {
+			t.Errorf("Get() %.8s: got = %q, %v, want = %q, %v", tt.key, value, err, values[i], errs[i])
+		}
+	}
+}
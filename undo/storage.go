@@ -1 +1,222 @@
 package undo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/manager/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// errUndoPageChecksum the checksum of an undo page is wrong
+	errUndoPageChecksum = errors.New("undo page checksum error")
+)
+
+const (
+	// 每个段文件的页面数量，回收时整段删除
+	undoPagesPerSegment = 256
+)
+
+// undoStorage 段文件 ingens.undo.00000000 保存段号为 0 的页面
+type undoStorage struct {
+	path string
+
+	mu    sync.Mutex
+	files map[uint32]*os.File // segment -> file
+}
+
+func newUndoStorage(path string) *undoStorage {
+	return &undoStorage{path: path, files: make(map[uint32]*os.File)}
+}
+
+func undoPageKey(segment uint32, page uint16) string {
+	return strconv.FormatUint(uint64(segment)*undoPagesPerSegment+uint64(page), 10)
+}
+
+func parseUndoPageKey(key string) (uint32, uint16, error) {
+	pageno, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(pageno / undoPagesPerSegment), uint16(pageno % undoPagesPerSegment), nil
+}
+
+func (smgr *undoStorage) InitData() any {
+	return &undoPage{data: make([]byte, base.PageSize)}
+}
+
+// Read 读取页面，段文件中不存在的页面为空页面
+func (smgr *undoStorage) Read(key string, data any) error {
+	page := data.(*undoPage)
+	segment, pageno, err := parseUndoPageKey(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := smgr.file(segment)
+	if err != nil {
+		return err
+	}
+
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	n, err := f.ReadAt(page.data, int64(pageno)*int64(base.PageSize))
+	if err == io.EOF {
+		if n == 0 {
+			page.init()
+			return nil
+		}
+		for i := n; i < len(page.data); i++ {
+			page.data[i] = 0
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// 文件空洞中的页面全部为 0
+	if isZero(page.data) {
+		page.init()
+		return nil
+	}
+	sum := binary.BigEndian.Uint64(page.data[base.PageDataUpper:])
+	if sum != storage.Sum64(page.data[:base.PageDataUpper]) {
+		return errUndoPageChecksum
+	}
+	return nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (smgr *undoStorage) Write(key string, data any) error {
+	page := data.(*undoPage)
+	segment, pageno, err := parseUndoPageKey(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := smgr.file(segment)
+	if err != nil {
+		return err
+	}
+
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	binary.BigEndian.PutUint64(page.data[base.PageDataUpper:], storage.Sum64(page.data[:base.PageDataUpper]))
+	n, err := f.WriteAt(page.data, int64(pageno)*int64(base.PageSize))
+	if err != nil {
+		return err
+	}
+	if n != base.PageSize {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// file 返回段文件，不存在时创建
+func (smgr *undoStorage) file(segment uint32) (*os.File, error) {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	if f, ok := smgr.files[segment]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(smgr.name(segment), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	smgr.files[segment] = f
+	return f, nil
+}
+
+func (smgr *undoStorage) name(segment uint32) string {
+	return filepath.Join(smgr.path, fmt.Sprintf("ingens.undo.%08X", segment))
+}
+
+// segments 返回按顺序排列的段号
+func (smgr *undoStorage) segments() ([]uint32, error) {
+	matches, err := filepath.Glob(filepath.Join(smgr.path, "ingens.undo.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]uint32, 0, len(matches))
+	for _, m := range matches {
+		seg, err := strconv.ParseUint(filepath.Ext(m)[1:], 16, 32)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, uint32(seg))
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// pages 返回段文件中已经写入的页面数量
+func (smgr *undoStorage) pages(segment uint32) (uint16, error) {
+	f, err := smgr.file(segment)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(info.Size() / int64(base.PageSize)), nil
+}
+
+func (smgr *undoStorage) remove(segment uint32) error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	if f, ok := smgr.files[segment]; ok {
+		f.Close()
+		delete(smgr.files, segment)
+	}
+
+	if err := os.Remove(smgr.name(segment)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (smgr *undoStorage) sync() error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	for _, f := range smgr.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (smgr *undoStorage) close() error {
+	smgr.mu.Lock()
+	defer smgr.mu.Unlock()
+
+	for segment, f := range smgr.files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		delete(smgr.files, segment)
+	}
+	return nil
+}
@@ -1,25 +1,354 @@
 package undo
 
 import (
+	"errors"
 	"github/suixinpr/ingens/base"
 	"github/suixinpr/ingens/manager/buffer"
-	"github/suixinpr/ingens/manager/storage"
 	"github/suixinpr/ingens/nodes"
+	"math"
+	"sync"
+	"sync/atomic"
 )
 
+var (
+	// ErrUndoRecordNotFound undo record does not exist or its segment has been discarded
+	ErrUndoRecordNotFound = errors.New("undo record does not exist")
+
+	// errUndoRecordChecksum the checksum of an undo record is wrong
+	errUndoRecordChecksum = errors.New("undo record checksum error")
+
+	// errUndoRecordTooLarge the undo record can not fit into an undo page
+	errUndoRecordTooLarge = errors.New("undo record is too large")
+
+	// errUndoSegmentExhausted all segment numbers have been used
+	errUndoSegmentExhausted = errors.New("undo segment numbers are exhausted")
+)
+
+const (
+	// undo 页面缓存的数量
+	undoBufferCapacity  = 256 // 256 * 64KB = 16MB
+	undoBufferBucketNum = 32
+)
+
+// UndoManager 管理 undo log，记录追加到段文件 ingens.undo.XXXXXXXX 中
+// 页面通过 BufferManager 缓存，在 Flush 或者淘汰时写回
 type UndoManager struct {
-	smgr *storage.StorageManager
+	smgr *undoStorage
 	bmgr *buffer.BufferManager
+
+	// 追加位置
+	mu      sync.Mutex
+	segment uint32
+	page    uint16
+	maxTids map[uint32]base.TransactionId // 段中记录的最大 tid，重启时扫描段恢复
+
+	// 小于该段号的段已经删除
+	discarded uint32
+
+	// tid -> 事务最后一条回滚记录
+	heads sync.Map
+
+	// 追加的记录数量和已经落盘的记录数量，没有新记录时 Flush 直接返回
+	appended uint64
+	flushed  uint64
+}
+
+// OpenUndoManager 打开 path 目录下的 undo log，从最后一个页面继续追加
+func OpenUndoManager(path string) (*UndoManager, error) {
+	smgr := newUndoStorage(path)
+	umgr := &UndoManager{
+		smgr: smgr,
+		bmgr: buffer.NewBufferPool(undoBufferCapacity, undoBufferBucketNum, base.PageSize, smgr),
+
+		maxTids: make(map[uint32]base.TransactionId),
+	}
+
+	segs, err := smgr.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		umgr.discarded = segs[0]
+		umgr.segment = segs[len(segs)-1]
+		pages, err := smgr.pages(umgr.segment)
+		if err != nil {
+			return nil, err
+		}
+		if pages > 0 {
+			umgr.page = pages - 1
+		}
+	}
+	return umgr, nil
 }
 
-func NewUndoManager() *UndoManager {
+// Recover 重启后扫描所有段，恢复每个段中记录的最大 tid
+// unfinished 返回 true 的事务随重启中断，恢复它们最后一条回滚记录，由调用者回滚
+func (umgr *UndoManager) Recover(unfinished func(base.TransactionId) bool) error {
+	segs, err := umgr.smgr.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		pages, err := umgr.smgr.pages(seg)
+		if err != nil {
+			return err
+		}
+
+		for pageno := uint16(0); pageno < pages; pageno++ {
+			key := undoPageKey(seg, pageno)
+			page, err := umgr.getPage(key, false)
+			if err != nil {
+				return err
+			}
+
+			// 记录按顺序追加，同一事务后面的记录指向前面的记录
+			page.mu.RLock()
+			for off := upHeaderSize; ; {
+				rec, ok := page.record(off)
+				if !ok || !rec.verify() {
+					break
+				}
+
+				tid := rec.Tid()
+				if tid > umgr.maxTids[seg] {
+					umgr.maxTids[seg] = tid
+				}
+				if unfinished(tid) {
+					umgr.heads.Store(tid, base.MakeUndoRecordPtr(seg, pageno, off))
+				}
+				off += rec.Size()
+			}
+			page.mu.RUnlock()
+			umgr.bmgr.ReleaseBufferData(key)
+		}
+	}
 	return nil
 }
 
-func (umgr *UndoManager) NewUndoRecordPtr(tid base.TransactionId, entry nodes.DataEntry) base.UndoRecordPtr {
-	return 0
+// NewUndoRecordPtr 为事务追加一条回滚记录
+// 新记录指向该事务的上一条记录，返回新记录的位置
+func (umgr *UndoManager) NewUndoRecordPtr(tid base.TransactionId, opr uint8, data []byte) (base.UndoRecordPtr, error) {
+	// 记录的长度为 uint16，构造之前检查
+	if int(urHeaderSize)+len(data) > int(base.PageDataUpper-upHeaderSize) {
+		return base.InvalidUndoRecordPtr, errUndoRecordTooLarge
+	}
+	prev := umgr.LastUndoRecordPtr(tid)
+	rec := newUndoRecord(prev, tid, opr, data)
+
+	umgr.mu.Lock()
+	defer umgr.mu.Unlock()
+
+	key := undoPageKey(umgr.segment, umgr.page)
+	page, err := umgr.getPage(key, false)
+	if err != nil {
+		return base.InvalidUndoRecordPtr, err
+	}
+
+	page.mu.Lock()
+	if page.freeSpace() < base.OffsetNumber(len(rec)) {
+		// 当前页面已满，记录不跨页面
+		page.mu.Unlock()
+		umgr.bmgr.ReleaseBufferData(key)
+
+		if umgr.page+1 == undoPagesPerSegment {
+			if umgr.segment == math.MaxUint32 {
+				return base.InvalidUndoRecordPtr, errUndoSegmentExhausted
+			}
+			umgr.segment++
+			umgr.page = 0
+		} else {
+			umgr.page++
+		}
+
+		key = undoPageKey(umgr.segment, umgr.page)
+		if page, err = umgr.getPage(key, true); err != nil {
+			return base.InvalidUndoRecordPtr, err
+		}
+		page.mu.Lock()
+		page.init()
+	}
+	off := page.append(rec)
+	page.mu.Unlock()
+	atomic.AddUint64(&umgr.appended, 1)
+
+	umgr.bmgr.MarkDirty(key)
+	umgr.bmgr.ReleaseBufferData(key)
+
+	if tid > umgr.maxTids[umgr.segment] {
+		umgr.maxTids[umgr.segment] = tid
+	}
+
+	ptr := base.MakeUndoRecordPtr(umgr.segment, umgr.page, off)
+	umgr.heads.Store(tid, ptr)
+	return ptr, nil
 }
 
-func (umgr *UndoManager) SearchInVersionChain(entry nodes.DataEntry, snapshot base.TransactionId) nodes.DataEntry {
-	return nil
+// GetUndoRecord 返回 ptr 处记录的副本
+func (umgr *UndoManager) GetUndoRecord(ptr base.UndoRecordPtr) (UndoRecord, error) {
+	if ptr == base.InvalidUndoRecordPtr || ptr.Segment() < atomic.LoadUint32(&umgr.discarded) {
+		return nil, ErrUndoRecordNotFound
+	}
+
+	key := undoPageKey(ptr.Segment(), ptr.Page())
+	page, err := umgr.getPage(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer umgr.bmgr.ReleaseBufferData(key)
+
+	page.mu.RLock()
+	rec, ok := page.record(ptr.Offset())
+	page.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUndoRecordNotFound
+	}
+	if !rec.verify() {
+		return nil, errUndoRecordChecksum
+	}
+	return rec, nil
+}
+
+// LastUndoRecordPtr 返回事务最后一条回滚记录
+func (umgr *UndoManager) LastUndoRecordPtr(tid base.TransactionId) base.UndoRecordPtr {
+	if v, ok := umgr.heads.Load(tid); ok {
+		return v.(base.UndoRecordPtr)
+	}
+	return base.InvalidUndoRecordPtr
+}
+
+// FinishTransaction 事务提交后不再追加记录
+// 已有的记录仍然保留，旧版本的读取需要它们
+func (umgr *UndoManager) FinishTransaction(tid base.TransactionId) {
+	umgr.heads.Delete(tid)
+}
+
+// DiscardTransaction 事务回滚完成后丢弃其所有记录
+func (umgr *UndoManager) DiscardTransaction(tid base.TransactionId) {
+	umgr.DiscardAfter(tid, base.InvalidUndoRecordPtr)
+}
+
+// DiscardAfter 回滚到 until 之后丢弃事务在 until 之后的记录
+// 事务之后追加的记录重新指向 until，记录占用的空间由段回收释放
+func (umgr *UndoManager) DiscardAfter(tid base.TransactionId, until base.UndoRecordPtr) {
+	if until == base.InvalidUndoRecordPtr {
+		umgr.heads.Delete(tid)
+	} else {
+		umgr.heads.Store(tid, until)
+	}
+}
+
+// SearchInVersionChain 沿版本链查找 visible 可见的最新旧版本，返回的版本可能已经被删除
+// 链上的版本由 UNDO_UPDATE 和 UNDO_DELETE 记录保存，到达 UNDO_INSERT 记录或者链尾时
+// 说明此前 key 不存在，返回 nil
+func (umgr *UndoManager) SearchInVersionChain(entry nodes.DataEntry, visible func(base.TransactionId) bool) (nodes.DataEntry, error) {
+	ptr := entry.Prev()
+	for ptr != base.InvalidUndoRecordPtr {
+		rec, err := umgr.GetUndoRecord(ptr)
+		if err != nil {
+			return nil, err
+		}
+
+		old := rec.Entry()
+		if old == nil {
+			return nil, nil
+		}
+		if visible(old.Tid()) {
+			return old, nil
+		}
+		ptr = old.Prev()
+	}
+	return nil, nil
+}
+
+// Discard 按顺序删除所有记录都由小于 oldest 的事务写入的段，返回删除的段数量
+// 当前追加的段不删除
+func (umgr *UndoManager) Discard(oldest base.TransactionId) (int, error) {
+	umgr.mu.Lock()
+	current := umgr.segment
+	umgr.mu.Unlock()
+
+	// 先写回缓存的页面，避免淘汰时重新创建已删除的段
+	if err := umgr.bmgr.Flush(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for seg := atomic.LoadUint32(&umgr.discarded); seg < current; seg++ {
+		umgr.mu.Lock()
+		maxTid := umgr.maxTids[seg]
+		umgr.mu.Unlock()
+		if maxTid >= oldest {
+			break
+		}
+
+		if err := umgr.smgr.remove(seg); err != nil {
+			return n, err
+		}
+
+		umgr.mu.Lock()
+		delete(umgr.maxTids, seg)
+		umgr.mu.Unlock()
+		atomic.StoreUint32(&umgr.discarded, seg+1)
+		n++
+	}
+	return n, nil
+}
+
+// Segments 返回段的数量
+func (umgr *UndoManager) Segments() int {
+	umgr.mu.Lock()
+	defer umgr.mu.Unlock()
+	return int(umgr.segment-atomic.LoadUint32(&umgr.discarded)) + 1
+}
+
+// Size 返回段占用的空间
+func (umgr *UndoManager) Size() int64 {
+	umgr.mu.Lock()
+	defer umgr.mu.Unlock()
+
+	segs := int64(umgr.segment - atomic.LoadUint32(&umgr.discarded))
+	pages := segs*undoPagesPerSegment + int64(umgr.page) + 1
+	return pages * int64(base.PageSize)
+}
+
+// Flush 写回所有修改过的页面
+// 节点页面写回之前调用，保证页面引用的回滚记录先落盘
+func (umgr *UndoManager) Flush() error {
+	n := atomic.LoadUint64(&umgr.appended)
+	if atomic.LoadUint64(&umgr.flushed) == n {
+		return nil
+	}
+
+	if err := umgr.bmgr.Flush(); err != nil {
+		return err
+	}
+	if err := umgr.smgr.sync(); err != nil {
+		return err
+	}
+
+	// 并发的 Flush 可能先完成更大的 n
+	for {
+		flushed := atomic.LoadUint64(&umgr.flushed)
+		if flushed >= n || atomic.CompareAndSwapUint64(&umgr.flushed, flushed, n) {
+			return nil
+		}
+	}
+}
+
+// Close 写回所有页面并关闭段文件
+func (umgr *UndoManager) Close() error {
+	if err := umgr.Flush(); err != nil {
+		return err
+	}
+	return umgr.smgr.close()
+}
+
+func (umgr *UndoManager) getPage(key string, new bool) (*undoPage, error) {
+	data, err := umgr.bmgr.GetBufferData(key, new)
+	if err != nil {
+		return nil, err
+	}
+	return data.(*undoPage), nil
 }
@@ -1 +1,73 @@
 package undo
+
+import (
+	"encoding/binary"
+	"github/suixinpr/ingens/base"
+	"sync"
+)
+
+// The structure of the undo page is as follows
+//
+// +-------+----------+----------+-----+-------------+----------+
+// | lower | record 1 | record 2 | ... | free space  | checksum |
+// +-------+----------+----------+-----+-------------+----------+
+//
+// records are appended in order and never modified, lower is the offset of
+// the free space. An undo record never spans pages.
+
+const (
+	upLowerPos = base.OffsetNumber(0)
+
+	// undo page header size
+	upHeaderSize = base.OffsetNumber(8)
+)
+
+type undoPage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// init 初始化为空页面
+func (page *undoPage) init() {
+	for i := range page.data {
+		page.data[i] = 0
+	}
+	page.setLower(upHeaderSize)
+}
+
+func (page *undoPage) lower() base.OffsetNumber {
+	return base.OffsetNumber(binary.BigEndian.Uint16(page.data[upLowerPos:]))
+}
+
+func (page *undoPage) setLower(lower base.OffsetNumber) {
+	binary.BigEndian.PutUint16(page.data[upLowerPos:], uint16(lower))
+}
+
+// freeSpace 剩余空间
+func (page *undoPage) freeSpace() base.OffsetNumber {
+	return base.PageDataUpper - page.lower()
+}
+
+// append 追加一条记录，返回记录在页面中的位置
+func (page *undoPage) append(rec UndoRecord) base.OffsetNumber {
+	off := page.lower()
+	copy(page.data[off:], rec)
+	page.setLower(off + base.OffsetNumber(len(rec)))
+	return off
+}
+
+// record 复制 off 处的记录，页面可能在返回后被淘汰
+func (page *undoPage) record(off base.OffsetNumber) (UndoRecord, bool) {
+	if off < upHeaderSize || off+urHeaderSize > page.lower() {
+		return nil, false
+	}
+
+	size := base.OffsetNumber(binary.BigEndian.Uint16(page.data[off+urSizePos:]))
+	if size < urHeaderSize || off+size > page.lower() {
+		return nil, false
+	}
+
+	rec := make(UndoRecord, size)
+	copy(rec, page.data[off:off+size])
+	return rec, true
+}
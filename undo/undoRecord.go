@@ -1,14 +1,122 @@
 package undo
 
 import (
+	"encoding/binary"
 	"github/suixinpr/ingens/base"
+	"github/suixinpr/ingens/nodes"
+	"hash/fnv"
+	"unsafe"
 )
 
+// The structure of the undo record is as follows
+//
+// +------------------+------------------------------+
+// | undoRecordHeader |             data             |
+// +------------------+------------------------------+
+//
+// undoRecordHeader holds the information of the undo record
+// prev points to the previous undo record of the same transaction
+// checksum covers the whole record except the checksum itself
+// data is the key of the inserted entry (UNDO_INSERT)
+// or the image of the entry before modification (UNDO_UPDATE, UNDO_DELETE)
+
 type (
 	undoRecordHeader struct {
-		prev base.UndoRecordPtr
-		size base.OffsetNumber
+		prev     base.UndoRecordPtr
+		tid      base.TransactionId
+		checksum uint64
+		size     base.OffsetNumber
+		opr      uint8
 	}
 
 	UndoRecord []byte
 )
+
+const (
+	// member offset in undo record header
+	urPrevPos     = base.OffsetNumber(unsafe.Offsetof(undoRecordHeader{}.prev))
+	urTidPos      = base.OffsetNumber(unsafe.Offsetof(undoRecordHeader{}.tid))
+	urChecksumPos = base.OffsetNumber(unsafe.Offsetof(undoRecordHeader{}.checksum))
+	urSizePos     = base.OffsetNumber(unsafe.Offsetof(undoRecordHeader{}.size))
+	urOprPos      = base.OffsetNumber(unsafe.Offsetof(undoRecordHeader{}.opr))
+
+	// undo record header size
+	urHeaderSize = base.OffsetNumber(unsafe.Sizeof(undoRecordHeader{}))
+)
+
+const (
+	UNDO_INSERT uint8 = iota
+	UNDO_UPDATE
+	UNDO_DELETE
+)
+
+func newUndoRecord(prev base.UndoRecordPtr, tid base.TransactionId, opr uint8, data []byte) UndoRecord {
+	size := urHeaderSize + base.OffsetNumber(len(data))
+	rec := make(UndoRecord, size)
+
+	// undo record header
+	binary.BigEndian.PutUint64(rec[urPrevPos:], uint64(prev))
+	binary.BigEndian.PutUint64(rec[urTidPos:], uint64(tid))
+	binary.BigEndian.PutUint16(rec[urSizePos:], uint16(size))
+	rec[urOprPos] = opr
+
+	// data
+	copy(rec[urHeaderSize:], data)
+
+	// checksum
+	binary.BigEndian.PutUint64(rec[urChecksumPos:], rec.sum())
+
+	return rec
+}
+
+// sum 计算除 checksum 之外的校验和
+func (rec UndoRecord) sum() uint64 {
+	f := fnv.New64()
+	f.Write(rec[:urChecksumPos])
+	f.Write(rec[urChecksumPos+8:])
+	return f.Sum64()
+}
+
+// verify 检查记录是否完整
+func (rec UndoRecord) verify() bool {
+	if len(rec) < int(urHeaderSize) || int(rec.Size()) != len(rec) {
+		return false
+	}
+	return binary.BigEndian.Uint64(rec[urChecksumPos:]) == rec.sum()
+}
+
+func (rec UndoRecord) Prev() base.UndoRecordPtr {
+	return base.UndoRecordPtr(binary.BigEndian.Uint64(rec[urPrevPos:]))
+}
+
+func (rec UndoRecord) Tid() base.TransactionId {
+	return base.TransactionId(binary.BigEndian.Uint64(rec[urTidPos:]))
+}
+
+func (rec UndoRecord) Size() base.OffsetNumber {
+	return base.OffsetNumber(binary.BigEndian.Uint16(rec[urSizePos:]))
+}
+
+func (rec UndoRecord) Opr() uint8 {
+	return rec[urOprPos]
+}
+
+func (rec UndoRecord) Data() []byte {
+	return rec[urHeaderSize:rec.Size()]
+}
+
+// Key 返回记录对应的 key
+func (rec UndoRecord) Key() []byte {
+	if rec.Opr() == UNDO_INSERT {
+		return rec.Data()
+	}
+	return rec.Entry().Key()
+}
+
+// Entry 返回修改前的 DataEntry，UNDO_INSERT 记录没有旧版本
+func (rec UndoRecord) Entry() nodes.DataEntry {
+	if rec.Opr() == UNDO_INSERT {
+		return nil
+	}
+	return nodes.DataEntry(rec.Data())
+}
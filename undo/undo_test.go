@@ -0,0 +1,171 @@
+package undo
+
+import (
+	"bytes"
+	"github/suixinpr/ingens/base"
+	"testing"
+)
+
+// pageRecord 每条记录独占一个页面
+var pageRecord = bytes.Repeat([]byte{'u'}, int(base.PageDataUpper-upHeaderSize-urHeaderSize)/2+1)
+
+func TestAppendAndRead(t *testing.T) {
+	umgr, err := OpenUndoManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenUndoManager() err: %v", err)
+	}
+	defer umgr.Close()
+
+	test := []struct {
+		tid  base.TransactionId
+		opr  uint8
+		data []byte
+	}{
+		{1, UNDO_INSERT, []byte("a")},
+		{2, UNDO_INSERT, []byte("b")},
+		{1, UNDO_INSERT, []byte("c")},
+		{1, UNDO_INSERT, pageRecord},
+		{2, UNDO_INSERT, []byte("d")},
+	}
+
+	ptrs := make([]base.UndoRecordPtr, len(test))
+	for i, tt := range test {
+		ptrs[i], err = umgr.NewUndoRecordPtr(tt.tid, tt.opr, tt.data)
+		if err != nil {
+			t.Fatalf("NewUndoRecordPtr() %d err: %v", i, err)
+		}
+	}
+
+	// 每条记录指向同一事务的上一条记录
+	last := map[base.TransactionId]base.UndoRecordPtr{}
+	for i, tt := range test {
+		rec, err := umgr.GetUndoRecord(ptrs[i])
+		if err != nil {
+			t.Fatalf("GetUndoRecord() %d err: %v", i, err)
+		}
+		if rec.Tid() != tt.tid || rec.Opr() != tt.opr || !bytes.Equal(rec.Data(), tt.data) {
+			t.Errorf("GetUndoRecord() %d: got = %v, %v, want = %v, %v", i, rec.Tid(), rec.Opr(), tt.tid, tt.opr)
+		}
+		if rec.Prev() != last[tt.tid] {
+			t.Errorf("Prev() %d: got = %x, want = %x", i, rec.Prev(), last[tt.tid])
+		}
+		last[tt.tid] = ptrs[i]
+	}
+
+	for tid, ptr := range last {
+		if got := umgr.LastUndoRecordPtr(tid); got != ptr {
+			t.Errorf("LastUndoRecordPtr(%v): got = %x, want = %x", tid, got, ptr)
+		}
+	}
+
+	if _, err := umgr.NewUndoRecordPtr(1, UNDO_INSERT, make([]byte, base.PageSize)); err != errUndoRecordTooLarge {
+		t.Errorf("NewUndoRecordPtr() too large: got = %v, want = %v", err, errUndoRecordTooLarge)
+	}
+}
+
+func TestRecordChecksum(t *testing.T) {
+	umgr, err := OpenUndoManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenUndoManager() err: %v", err)
+	}
+	defer umgr.Close()
+
+	ptr, err := umgr.NewUndoRecordPtr(1, UNDO_INSERT, []byte("key"))
+	if err != nil {
+		t.Fatalf("NewUndoRecordPtr() err: %v", err)
+	}
+
+	// 修改页面中的记录
+	key := undoPageKey(ptr.Segment(), ptr.Page())
+	page, err := umgr.getPage(key, false)
+	if err != nil {
+		t.Fatalf("getPage() err: %v", err)
+	}
+	page.mu.Lock()
+	page.data[ptr.Offset()+urHeaderSize] ^= 0xff
+	page.mu.Unlock()
+	umgr.bmgr.ReleaseBufferData(key)
+
+	if _, err := umgr.GetUndoRecord(ptr); err != errUndoRecordChecksum {
+		t.Errorf("GetUndoRecord(): got = %v, want = %v", err, errUndoRecordChecksum)
+	}
+
+	// 不存在的记录
+	missing := base.MakeUndoRecordPtr(ptr.Segment(), ptr.Page(), ptr.Offset()+200)
+	if _, err := umgr.GetUndoRecord(missing); err != ErrUndoRecordNotFound {
+		t.Errorf("GetUndoRecord() missing: got = %v, want = %v", err, ErrUndoRecordNotFound)
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	path := t.TempDir()
+	umgr, err := OpenUndoManager(path)
+	if err != nil {
+		t.Fatalf("OpenUndoManager() err: %v", err)
+	}
+
+	// 三个段，tid 依次为 1、2、3
+	var ptrs []base.UndoRecordPtr
+	for i := 0; i < 2*undoPagesPerSegment+1; i++ {
+		tid := base.TransactionId(i/undoPagesPerSegment + 1)
+		ptr, err := umgr.NewUndoRecordPtr(tid, UNDO_INSERT, pageRecord)
+		if err != nil {
+			t.Fatalf("NewUndoRecordPtr() %d err: %v", i, err)
+		}
+		if want := uint32(i / undoPagesPerSegment); ptr.Segment() != want {
+			t.Fatalf("Segment() %d: got = %v, want = %v", i, ptr.Segment(), want)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	if got := umgr.Segments(); got != 3 {
+		t.Errorf("Segments(): got = %v, want = 3", got)
+	}
+	if err := umgr.Close(); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+
+	// 重启后从段中恢复最大 tid 和中断事务的最后一条记录
+	umgr, err = OpenUndoManager(path)
+	if err != nil {
+		t.Fatalf("OpenUndoManager() again err: %v", err)
+	}
+	defer umgr.Close()
+
+	err = umgr.Recover(func(tid base.TransactionId) bool { return tid == 2 })
+	if err != nil {
+		t.Fatalf("Recover() err: %v", err)
+	}
+	if got, want := umgr.LastUndoRecordPtr(2), ptrs[2*undoPagesPerSegment-1]; got != want {
+		t.Errorf("LastUndoRecordPtr(2): got = %x, want = %x", got, want)
+	}
+	if got := umgr.LastUndoRecordPtr(1); got != base.InvalidUndoRecordPtr {
+		t.Errorf("LastUndoRecordPtr(1): got = %x, want = %x", got, base.InvalidUndoRecordPtr)
+	}
+
+	test := []struct {
+		oldest   base.TransactionId
+		segments int // 删除的段数量
+		left     int
+	}{
+		{1, 0, 3},
+		{2, 1, 2},
+		{2, 0, 2},
+		{10, 1, 1}, // 当前追加的段不删除
+	}
+	for _, tt := range test {
+		n, err := umgr.Discard(tt.oldest)
+		if err != nil {
+			t.Fatalf("Discard(%v) err: %v", tt.oldest, err)
+		}
+		if n != tt.segments || umgr.Segments() != tt.left {
+			t.Errorf("Discard(%v): got = %v, %v, want = %v, %v", tt.oldest, n, umgr.Segments(), tt.segments, tt.left)
+		}
+	}
+
+	if _, err := umgr.GetUndoRecord(ptrs[0]); err != ErrUndoRecordNotFound {
+		t.Errorf("GetUndoRecord() discarded: got = %v, want = %v", err, ErrUndoRecordNotFound)
+	}
+	if _, err := umgr.GetUndoRecord(ptrs[len(ptrs)-1]); err != nil {
+		t.Errorf("GetUndoRecord() current: got = %v, want = nil", err)
+	}
+}